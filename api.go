@@ -0,0 +1,231 @@
+package main
+
+import (
+	"dns-resolver/socket"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// resolvePath is where the json api is served
+	resolvePath = "/resolve"
+	// dnsJSONType is the media type of the json api responses
+	dnsJSONType = "application/dns-json"
+)
+
+// resolver looks names up through the server cache and upstreams, it's
+// implemented by socket.Socket.
+type resolver interface {
+	Resolve(name string, qtype dnsmessage.Type, checkingDisabled, dnssecOK bool) (*dnsmessage.Message, error)
+}
+
+// typeNames maps the record type names accepted by the type parameter to
+// their value.
+var typeNames = map[string]dnsmessage.Type{
+	"A":      dnsmessage.TypeA,
+	"NS":     dnsmessage.TypeNS,
+	"CNAME":  dnsmessage.TypeCNAME,
+	"SOA":    dnsmessage.TypeSOA,
+	"PTR":    dnsmessage.TypePTR,
+	"MX":     dnsmessage.TypeMX,
+	"TXT":    dnsmessage.TypeTXT,
+	"AAAA":   dnsmessage.TypeAAAA,
+	"SRV":    dnsmessage.TypeSRV,
+	"HINFO":  dnsmessage.TypeHINFO,
+	"ANY":    dnsmessage.TypeALL,
+	"DS":     43,
+	"RRSIG":  46,
+	"NSEC":   47,
+	"DNSKEY": 48,
+	"NSEC3":  50,
+	"SVCB":   64,
+	"HTTPS":  65,
+	"CAA":    257,
+}
+
+// parseType parses the type parameter, a type name or number, A if empty.
+func parseType(s string) (dnsmessage.Type, error) {
+	if s == "" {
+		return dnsmessage.TypeA, nil
+	}
+	if t, ok := typeNames[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "TYPE"), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid type %q", s)
+	}
+	return dnsmessage.Type(n), nil
+}
+
+// parseFlag parses the cd and do parameters, both empty and false values
+// leave the flag unset.
+func parseFlag(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+// resolveHandler answers GET /resolve?name=example.com&type=MX with a
+// ServerResponse, resolved through the server cache and upstreams.
+func resolveHandler(r resolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := req.URL.Query()
+		name := params.Get("name")
+		if name == "" || len(name) > 253 {
+			http.Error(w, "invalid name parameter", http.StatusBadRequest)
+			return
+		}
+		qtype, err := parseType(params.Get("type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		msg, err := r.Resolve(name, qtype, parseFlag(params.Get("cd")), parseFlag(params.Get("do")))
+		if err != nil {
+			// only the name is the client's fault, the other errors are the
+			// query being dropped or the server shutting down
+			status := http.StatusBadGateway
+			if errors.Is(err, socket.ErrInvalidName) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		resp := newServerResponse(name, msg)
+		w.Header().Set("Content-Type", dnsJSONType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", resp.minTTL()))
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// newServerResponse converts the response to a lookup of host.
+func newServerResponse(host string, msg *dnsmessage.Message) ServerResponse {
+	resp := ServerResponse{
+		Status:     int(msg.RCode),
+		TC:         msg.Truncated,
+		RD:         msg.RecursionDesired,
+		RA:         msg.RecursionAvailable,
+		AD:         msg.AuthenticData,
+		CD:         msg.CheckingDisabled,
+		Question:   []JSONQuestion{},
+		Answer:     jsonRecords(msg.Answers),
+		Authority:  jsonRecords(msg.Authorities),
+		Additional: jsonRecords(msg.Additionals),
+		Host:       host,
+	}
+	for _, q := range msg.Questions {
+		resp.Question = append(resp.Question, JSONQuestion{Name: q.Name.String(), Type: uint16(q.Type)})
+	}
+	// the extended rcode bits are carried by the opt record
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			resp.Status |= int(r.Header.ExtendedRCode(0))
+		}
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		resp.Error = fmt.Sprintf("response code %d", resp.Status)
+	}
+
+	for _, r := range msg.Answers {
+		switch b := r.Body.(type) {
+		case *dnsmessage.AResource:
+			resp.IPs = append(resp.IPs, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			resp.IPs = append(resp.IPs, net.IP(b.AAAA[:]).String())
+		case *dnsmessage.MXResource:
+			resp.MXrecord = append(resp.MXrecord, MXrecord{Host: b.MX.String(), Pref: b.Pref, TTL: r.Header.TTL})
+		case *dnsmessage.CNAMEResource:
+			if resp.CNAMErecord == "" {
+				resp.CNAMErecord = b.CNAME.String()
+			}
+		}
+	}
+	return resp
+}
+
+// jsonRecords converts resource records, opt records are left out as they
+// aren't records.
+func jsonRecords(rs []dnsmessage.Resource) []JSONRecord {
+	var records []JSONRecord
+	for _, r := range rs {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		records = append(records, JSONRecord{
+			Name: r.Header.Name.String(),
+			Type: uint16(r.Header.Type),
+			TTL:  r.Header.TTL,
+			Data: rdata(r.Body),
+		})
+	}
+	return records
+}
+
+// rdata returns the presentation format of a record data, the generic one of
+// RFC 3597 for the types dnsmessage doesn't parse.
+func rdata(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String())
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target.String())
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS.String(), b.MBox.String(), b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dnsmessage.TXTResource:
+		quoted := make([]string, len(b.TXT))
+		for i, txt := range b.TXT {
+			quoted[i] = strconv.Quote(txt)
+		}
+		return strings.Join(quoted, " ")
+	case *dnsmessage.UnknownResource:
+		return fmt.Sprintf("\\# %d %s", len(b.Data), hex.EncodeToString(b.Data))
+	}
+	return ""
+}
+
+// minTTL returns the smallest ttl of the records, zero if there are none.
+func (r ServerResponse) minTTL() uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, rs := range [][]JSONRecord{r.Answer, r.Authority, r.Additional} {
+		for _, rec := range rs {
+			if !found || rec.TTL < ttl {
+				ttl, found = rec.TTL, true
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"dns-resolver/socket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubResolver answers every lookup with msg, or fails it with err,
+// recording the last one.
+type stubResolver struct {
+	msg   dnsmessage.Message
+	err   error
+	name  string
+	qtype dnsmessage.Type
+	do    bool
+}
+
+func (r *stubResolver) Resolve(name string, qtype dnsmessage.Type, _, dnssecOK bool) (*dnsmessage.Message, error) {
+	r.name, r.qtype, r.do = name, qtype, dnssecOK
+	if r.err != nil {
+		return nil, r.err
+	}
+	msg := r.msg
+	return &msg, nil
+}
+
+func TestResolveHandler(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	r := &stubResolver{msg: dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}},
+			},
+		},
+	}}
+	h := resolveHandler(r)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/resolve?name=example.com&type=mx&do=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bad status: %d %s", rec.Code, rec.Body)
+	}
+	if r.name != "example.com" || r.qtype != dnsmessage.TypeMX || !r.do {
+		t.Errorf("bad lookup: %s %v do=%v", r.name, r.qtype, r.do)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/dns-json" {
+		t.Errorf("bad content type: %s", ct)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("bad cache control: %s", cc)
+	}
+
+	var resp ServerResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 0 || !resp.RD || !resp.RA || len(resp.Question) != 1 || resp.Question[0].Type != 15 {
+		t.Errorf("bad response: %+v", resp)
+	}
+	want := []JSONRecord{
+		{Name: "example.com.", Type: 15, TTL: 300, Data: "10 mail.example.com."},
+		{Name: "example.com.", Type: 16, TTL: 60, Data: `"v=spf1 -all"`},
+	}
+	if len(resp.Answer) != len(want) {
+		t.Fatalf("bad answers: %+v", resp.Answer)
+	}
+	for i := range want {
+		if resp.Answer[i] != want[i] {
+			t.Errorf("answer %d: got %+v, want %+v", i, resp.Answer[i], want[i])
+		}
+	}
+	if len(resp.MXrecord) != 1 || resp.MXrecord[0] != (MXrecord{Host: "mail.example.com.", Pref: 10, TTL: 300}) {
+		t.Errorf("bad mx records: %+v", resp.MXrecord)
+	}
+
+	for _, target := range []string{"/resolve", "/resolve?name=example.com&type=BOGUS"} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", target, rec.Code)
+		}
+	}
+
+	for err, want := range map[error]int{
+		fmt.Errorf("%w %q", socket.ErrInvalidName, "a..b."): http.StatusBadRequest,
+		errors.New("no response for example.com."):          http.StatusBadGateway,
+	} {
+		r.err = err
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/resolve?name=example.com", nil))
+		if rec.Code != want {
+			t.Errorf("%v: got status %d, want %d", err, rec.Code, want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -30,7 +31,90 @@ type (
 		DNSAddr   string
 		CacheSize int
 		Workers   int
+
+		// HealthInterval is how often upstreams are probed, MaxFails is the
+		// number of consecutive failures before an upstream is marked down
+		HealthInterval time.Duration
+		MaxFails       int
+		// UpstreamTimeout bounds each attempt, failed rounds over the
+		// upstreams are retried Retries times waiting RetryBackoff (doubled
+		// on each retry) in between
+		UpstreamTimeout time.Duration
+		Retries         int
+		RetryBackoff    time.Duration
+		// UpstreamConns is the number of connections kept open to each
+		// upstream, per protocol
+		UpstreamConns int
+		// Strategy picks the upstream order, see socket.NewStrategy
+		Strategy string
+		// ForwardRules send the queries for some zones to other upstreams,
+		// see socket.ParseForwardRule
+		ForwardRules List
+
+		// MinCacheTTL and MaxCacheTTL clamp the ttl of cached answers,
+		// a zero MaxCacheTTL means no upper limit
+		MinCacheTTL time.Duration
+		MaxCacheTTL time.Duration
+		// MaxNegativeTTL caps how long NXDOMAIN and NODATA answers are cached
+		MaxNegativeTTL time.Duration
+
+		// EDNSSize is the largest udp response sent to EDNS0 clients
+		EDNSSize int
+
+		// TCP enables a DNS over TCP listener on Addr next to the udp one
+		TCP            bool
+		TCPIdleTimeout time.Duration
+		TCPMaxQueries  int
+
+		// DoTAddr enables a DNS over TLS listener, using CertFile and KeyFile.
+		// DoHAddr enables a DNS over HTTPS listener, over plain http when
+		// no certificate is given
+		DoTAddr  string
+		DoHAddr  string
+		CertFile string
+		KeyFile  string
+
+		// Hosts and Zones are comma separated lists of hosts files and
+		// RFC 1035 zone files of local records, answered before the
+		// blocklists, the cache and the upstreams
+		Hosts string
+		Zones string
+
+		// Blocklists and Allowlists are comma separated lists of files or
+		// http urls of blocked and allowed domains, BlockAnswer how the
+		// blocked names are answered: nxdomain, null or sinkhole addresses.
+		// These lists and the local records are reloaded each
+		// ReloadInterval, and on SIGHUP
+		Blocklists     string
+		Allowlists     string
+		BlockAnswer    string
+		ReloadInterval time.Duration
+
+		// MetricsAddr enables a plain http listener serving the prometheus
+		// metrics on /metrics
+		MetricsAddr string
+
+		// QueryLog is where a json record of the queries is written:
+		// stdout, syslog or a file, rotated once over QueryLogMaxSize
+		// megabytes keeping QueryLogBackups old files. QueryLogSample is
+		// the fraction of the queries logged
+		QueryLog        string
+		QueryLogSample  float64
+		QueryLogMaxSize int
+		QueryLogBackups int
+
+		// Dnstap is where the dnstap messages are written, unix:path for a
+		// collector socket or a file. DnstapWire includes the dns messages
+		Dnstap     string
+		DnstapWire bool
+
+		// ShutdownTimeout bounds how long the queries in flight are waited
+		// for when the server stops
+		ShutdownTimeout time.Duration
 	}
+
+	// List is a flag which can be given several times
+	List []string
 )
 
 // String return the default host for query
@@ -43,6 +127,15 @@ func (h *Hosts) Set(val string) error {
 	return nil
 }
 
+func (l *List) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *List) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
 func (a *Args) Parse() error {
 	cmd := flag.NewFlagSet("cmd", flag.ExitOnError)
 	cmd.BoolVar(&a.CmdArgs.A, "a", true, "search for A record")
@@ -54,10 +147,43 @@ func (a *Args) Parse() error {
 
 	server := flag.NewFlagSet("server", flag.ExitOnError)
 	server.StringVar(&a.SocketArgs.Addr, "addr", ":8000", "addr to listen on it")
-	server.StringVar(&a.SocketArgs.Network, "net", "udp", "socket type")
-	server.StringVar(&a.SocketArgs.DNSAddr, "dns", "1.1.1.1:53", "set custom dns for resolver")
+	server.StringVar(&a.SocketArgs.Network, "net", "udp", "socket type, only udp: use -tcp to accept tcp queries too")
+	server.StringVar(&a.SocketArgs.DNSAddr, "dns", "1.1.1.1:53", "comma separated list of upstream dns to forward queries to, each optionally followed by @weight. tls://host[:port] and https://host/path upstreams accept sni=name and pin=base64-sha256-of-spki url parameters")
+	server.StringVar(&a.SocketArgs.Strategy, "strategy", "sequential", "upstream selection: sequential, roundrobin, random or fastest")
+	server.Var(&a.SocketArgs.ForwardRules, "forward", "forward a zone and its subdomains to other upstreams: zone=upstream[,upstream...][;timeout=1s][;strategy=name][;cache=off][;mincachettl=1m][;maxcachettl=1h][;maxnegttl=1m], the zone being a domain, a reverse zone or a network like 10.0.0.0/8 (can be used multiple times, the longest matching zone wins)")
+	server.DurationVar(&a.SocketArgs.UpstreamTimeout, "timeout", 2*time.Second, "timeout of a single upstream exchange")
+	server.IntVar(&a.SocketArgs.Retries, "retries", 1, "times a query is retried after every upstream failed")
+	server.DurationVar(&a.SocketArgs.RetryBackoff, "backoff", 100*time.Millisecond, "wait before the first retry, doubled on each next one")
+	server.IntVar(&a.SocketArgs.UpstreamConns, "upstreamconns", 4, "connections kept open to each upstream, per protocol")
+	server.DurationVar(&a.SocketArgs.HealthInterval, "healthinterval", 10*time.Second, "how often upstreams are probed (0 disables probing)")
+	server.IntVar(&a.SocketArgs.MaxFails, "maxfails", 3, "consecutive failures before an upstream is marked down")
 	server.IntVar(&a.SocketArgs.CacheSize, "cachesize", 128, "cache size list")
 	server.IntVar(&a.SocketArgs.Workers, "worker", runtime.NumCPU(), "number of workers to run concurrently")
+	server.DurationVar(&a.SocketArgs.MinCacheTTL, "mincachettl", 0, "minimum time an answer is kept in cache, overrides smaller ttls")
+	server.DurationVar(&a.SocketArgs.MaxCacheTTL, "maxcachettl", 24*time.Hour, "maximum time an answer is kept in cache (0 for no limit)")
+	server.DurationVar(&a.SocketArgs.MaxNegativeTTL, "maxnegttl", time.Hour, "maximum time a nxdomain or nodata answer is kept in cache (0 for no limit)")
+	server.IntVar(&a.SocketArgs.EDNSSize, "ednssize", 1232, "largest udp response sent to clients advertising a bigger EDNS0 buffer")
+	server.BoolVar(&a.SocketArgs.TCP, "tcp", true, "also accept dns queries over tcp on addr")
+	server.DurationVar(&a.SocketArgs.TCPIdleTimeout, "tcpidle", 10*time.Second, "close tcp connections idle for longer than this")
+	server.IntVar(&a.SocketArgs.TCPMaxQueries, "tcpqueries", 100, "max queries served on one tcp connection (0 for unlimited)")
+	server.StringVar(&a.SocketArgs.DoTAddr, "dotaddr", "", "addr to listen on for dns over tls, e.g. :853 (needs -cert and -key)")
+	server.StringVar(&a.SocketArgs.DoHAddr, "dohaddr", "", "addr to listen on for dns over https, e.g. :443 (plain http without -cert and -key)")
+	server.StringVar(&a.SocketArgs.CertFile, "cert", "", "tls certificate file (PEM), used by -dotaddr and -dohaddr")
+	server.StringVar(&a.SocketArgs.KeyFile, "key", "", "tls private key file (PEM)")
+	server.StringVar(&a.SocketArgs.Hosts, "hosts", "", "comma separated list of hosts files of local names, answered along with their PTR records")
+	server.StringVar(&a.SocketArgs.Zones, "zones", "", "comma separated list of zone files (RFC 1035 format) of local records")
+	server.StringVar(&a.SocketArgs.Blocklists, "blocklist", "", "comma separated list of files or http(s) urls of domains to block: hosts files, plain domains, adblock ||domain^ rules or *.domain wildcards")
+	server.StringVar(&a.SocketArgs.Allowlists, "allowlist", "", "comma separated list of files or http(s) urls of domains never blocked, in the blocklist formats")
+	server.DurationVar(&a.SocketArgs.ReloadInterval, "reloadinterval", 24*time.Hour, "how often the local records, block and allow lists are reloaded, they are on SIGHUP too (0 disables the timed reload)")
+	server.StringVar(&a.SocketArgs.BlockAnswer, "blockanswer", "nxdomain", "answer to blocked names: nxdomain, null (0.0.0.0 and ::) or sinkhole ips, e.g. 10.0.0.1,fd00::1")
+	server.StringVar(&a.SocketArgs.MetricsAddr, "metricsaddr", "", "addr to serve prometheus metrics on at /metrics, e.g. :9153")
+	server.StringVar(&a.SocketArgs.QueryLog, "querylog", "", "write a json line per query to stdout, syslog or the given file")
+	server.Float64Var(&a.SocketArgs.QueryLogSample, "querylogsample", 1, "fraction of the queries written to the query log")
+	server.IntVar(&a.SocketArgs.QueryLogMaxSize, "querylogsize", 100, "size in megabytes a query log file is rotated at (0 for never)")
+	server.IntVar(&a.SocketArgs.QueryLogBackups, "querylogbackups", 3, "rotated query log files kept")
+	server.StringVar(&a.SocketArgs.Dnstap, "dnstap", "", "send dnstap messages to unix:/path/to/socket or write them to the given file")
+	server.BoolVar(&a.SocketArgs.DnstapWire, "dnstapwire", true, "include the dns messages in the dnstap messages")
+	server.DurationVar(&a.SocketArgs.ShutdownTimeout, "shutdowntimeout", 5*time.Second, "how long queries in flight are waited for on shutdown")
 
 	if len(os.Args) < 2 {
 		return fmt.Errorf("error occured while parsing flags: expected 'cmd' or 'server' subcommands")
@@ -97,6 +97,8 @@ func (c *LRU[K, V]) Peek(key K) (value V, ok bool) {
 // Remove removes the provided key from the cache, returning if the
 // key was contained.
 func (c *LRU[K, V]) Remove(key K) (present bool) {
+	c.Lock()
+	defer c.Unlock()
 	if ent, ok := c.items[key]; ok {
 		c.removeElement(ent)
 		return true
@@ -134,6 +136,8 @@ func (c *LRU[K, V]) Keys() []K {
 
 // Len returns the number of items in the cache.
 func (c *LRU[K, V]) Len() int {
+	c.RLock()
+	defer c.RUnlock()
 	return c.evictList.length()
 }
 
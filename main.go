@@ -29,12 +29,26 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if s.HTTPAddr() != nil {
+			if err := s.HandleHTTP(resolvePath, resolveHandler(s)); err != nil {
+				log.Fatal(err)
+			}
+		}
 		s.ListenAndServe()
 
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-		<-c
-		// s.Stop()
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+		for sig := <-c; sig == syscall.SIGHUP; sig = <-c {
+			// errors are logged, the lists in use are kept. Reloads are
+			// serialized, a slow one doesn't hold up a shutdown signal
+			go s.Reload()
+		}
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cmdArgs.SocketArgs.ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
 		return
 
 	} else {
@@ -15,16 +15,43 @@ type (
 		Error       []error
 	}
 
+	// ServerResponse is the answer of the json api, its capitalized fields
+	// follow the shape of the Google and Cloudflare dns json apis.
 	ServerResponse struct {
+		// Status is the rcode of the response
+		Status     int            `json:"Status"`
+		TC         bool           `json:"TC"`
+		RD         bool           `json:"RD"`
+		RA         bool           `json:"RA"`
+		AD         bool           `json:"AD"`
+		CD         bool           `json:"CD"`
+		Question   []JSONQuestion `json:"Question"`
+		Answer     []JSONRecord   `json:"Answer,omitempty"`
+		Authority  []JSONRecord   `json:"Authority,omitempty"`
+		Additional []JSONRecord   `json:"Additional,omitempty"`
+
 		Host        string     `json:"host"`
 		IPs         []string   `json:"ips,omitempty"`
 		MXrecord    []MXrecord `json:"mx_records,omitempty"`
 		CNAMErecord string     `json:"cname_record,omitempty"`
-		Error       []error
+		Error       string     `json:"Comment,omitempty"`
 	}
 	MXrecord struct {
-		Host string
-		Pref uint16
+		Host string `json:"host"`
+		Pref uint16 `json:"pref"`
+		TTL  uint32 `json:"ttl"`
+	}
+	JSONQuestion struct {
+		Name string `json:"name"`
+		Type uint16 `json:"type"`
+	}
+	// JSONRecord is a resource record, data is its rdata in presentation
+	// format.
+	JSONRecord struct {
+		Name string `json:"name"`
+		Type uint16 `json:"type"`
+		TTL  uint32 `json:"TTL"`
+		Data string `json:"data"`
 	}
 )
 
@@ -0,0 +1,361 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// blockedTTL is the ttl of the answers to blocked names, short so
+	// unblocking a name is seen quickly by the clients
+	blockedTTL = 10
+	// listTimeout bounds the download of a list from an http source
+	listTimeout = time.Minute
+)
+
+type (
+	// Blocklist is a set of blocked domains along with the allowed ones,
+	// which override them. It's not modified once built.
+	//
+	// The lists are read line by line, in any of these formats:
+	//
+	//	0.0.0.0 ads.example.com tracker.example.com   hosts file, exact names
+	//	ads.example.com                               plain list, exact name
+	//	||ads.example.com^                            adblock, the name and its subdomains
+	//	*.ads.example.com                             wildcard, the subdomains only
+	//	@@||cdn.example.com^                          adblock exception, allowed
+	//
+	// Lines starting with # or ! are comments, as is what follows a # on a
+	// line. Adblock rules with options other than $important are skipped, as
+	// they don't apply to dns.
+	Blocklist struct {
+		block, allow domainRules
+	}
+
+	// domainRules matches names against exact names, zones matching the
+	// name and its subdomains, and wildcards matching the subdomains only.
+	// The names are lower case and fully qualified.
+	domainRules struct {
+		exact      map[string]struct{}
+		zones      map[string]struct{}
+		subdomains map[string]struct{}
+		count      int
+	}
+
+	// Blocker is the plugin answering the queries for the names blocked by
+	// its Blocklist, which can be replaced while serving. A Blocker made by
+	// LoadBlocker reloads its lists from their sources on Reload.
+	Blocker struct {
+		list  atomic.Pointer[Blocklist]
+		rcode dnsmessage.RCode
+		ip4   *dnsmessage.AResource
+		ip6   *dnsmessage.AAAAResource
+
+		// reloadMu serializes the reloads of the sources
+		reloadMu               sync.Mutex
+		blocklists, allowlists []string
+	}
+)
+
+// NewBlocklist returns the blocklist built from the lists read from
+// blocklists and allowlists. The adblock exceptions of the blocklists are
+// allowed too, every rule of the allowlists allows the names it matches.
+func NewBlocklist(blocklists, allowlists []io.Reader) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, r := range blocklists {
+		if err := b.parse(r, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range allowlists {
+		if err := b.parse(r, true); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// LoadBlocklist returns the blocklist built from the sources of blocklists
+// and allowlists, see NewBlocklist. A source is the path of a file or an http
+// or https url.
+func LoadBlocklist(blocklists, allowlists []string) (*Blocklist, error) {
+	b := &Blocklist{}
+	for i, sources := range [][]string{blocklists, allowlists} {
+		for _, src := range sources {
+			if err := b.load(src, i == 1); err != nil {
+				return nil, fmt.Errorf("load %s: %w", src, err)
+			}
+		}
+	}
+	return b, nil
+}
+
+// load adds the rules of a source.
+func (b *Blocklist) load(src string, allow bool) error {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return b.parse(f, allow)
+	}
+	client := http.Client{Timeout: listTimeout}
+	resp, err := client.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return b.parse(resp.Body, allow)
+}
+
+// parse adds the rules of a list, allow adds them to the allowed names.
+func (b *Blocklist) parse(r io.Reader, allow bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		rules := &b.block
+		if allow {
+			rules = &b.allow
+		}
+		if len(fields) > 1 {
+			// hosts file entry
+			if net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, host := range fields[1:] {
+				if name, ok := normalizeDomain(host); ok && !localHost(name) {
+					rules.add(&rules.exact, name)
+				}
+			}
+			continue
+		}
+
+		rule := fields[0]
+		if strings.HasPrefix(rule, "@@") {
+			rule, rules = rule[2:], &b.allow
+		}
+		switch {
+		case strings.HasPrefix(rule, "||"):
+			domain, options, _ := strings.Cut(rule[2:], "^")
+			if options != "" && options != "$important" {
+				continue
+			}
+			if name, ok := normalizeDomain(domain); ok {
+				rules.add(&rules.zones, name)
+			}
+		case strings.HasPrefix(rule, "*."):
+			if name, ok := normalizeDomain(rule[2:]); ok {
+				rules.add(&rules.subdomains, name)
+			}
+		default:
+			if name, ok := normalizeDomain(rule); ok {
+				rules.add(&rules.exact, name)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// normalizeDomain returns the lower case fully qualified form of a domain,
+// false if it's not a valid one.
+func normalizeDomain(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return "", false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return "", false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", false
+			}
+		}
+	}
+	return s + ".", true
+}
+
+// localHost reports whether name is one of the local names of hosts files,
+// which are not blocked.
+func localHost(name string) bool {
+	switch name {
+	case "localhost.", "localhost.localdomain.", "local.", "broadcasthost.",
+		"ip6-localhost.", "ip6-loopback.", "ip6-localnet.", "ip6-mcastprefix.",
+		"ip6-allnodes.", "ip6-allrouters.", "ip6-allhosts.":
+		return true
+	}
+	return false
+}
+
+func (r *domainRules) add(set *map[string]struct{}, name string) {
+	if *set == nil {
+		*set = make(map[string]struct{})
+	}
+	if _, ok := (*set)[name]; !ok {
+		(*set)[name] = struct{}{}
+		r.count++
+	}
+}
+
+// match reports whether a lower case fully qualified name matches a rule.
+func (r *domainRules) match(name string) bool {
+	if _, ok := r.exact[name]; ok {
+		return true
+	}
+	for i := 0; i < len(name); {
+		suffix := name[i:]
+		if _, ok := r.zones[suffix]; ok {
+			return true
+		}
+		if _, ok := r.subdomains[suffix]; ok && i > 0 {
+			return true
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		i += dot + 1
+	}
+	return false
+}
+
+// Blocked reports whether name is blocked and not allowed.
+func (b *Blocklist) Blocked(name string) bool {
+	name = strings.ToLower(fqdn(name))
+	return b.block.match(name) && !b.allow.match(name)
+}
+
+// Len returns the number of rules blocking and allowing names.
+func (b *Blocklist) Len() (blocked, allowed int) {
+	return b.block.count, b.allow.count
+}
+
+// NewBlocker returns a Blocker using list. answer is how the blocked names
+// are answered: "nxdomain", "null" for 0.0.0.0 and :: addresses, or the
+// sinkhole addresses to answer with, an ipv4 and or an ipv6 one separated by
+// a comma. The other query types get an empty answer.
+func NewBlocker(list *Blocklist, answer string) (*Blocker, error) {
+	b := &Blocker{}
+	b.list.Store(list)
+	switch answer {
+	case "", "nxdomain":
+		b.rcode = dnsmessage.RCodeNameError
+	case "null":
+		b.ip4 = &dnsmessage.AResource{}
+		b.ip6 = &dnsmessage.AAAAResource{}
+	default:
+		for _, s := range strings.Split(answer, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("invalid block answer %q", answer)
+			case ip.To4() != nil && b.ip4 == nil:
+				b.ip4 = &dnsmessage.AResource{}
+				copy(b.ip4.A[:], ip.To4())
+			case ip.To4() == nil && b.ip6 == nil:
+				b.ip6 = &dnsmessage.AAAAResource{}
+				copy(b.ip6.AAAA[:], ip)
+			default:
+				return nil, fmt.Errorf("invalid block answer %q: one address per family", answer)
+			}
+		}
+	}
+	return b, nil
+}
+
+// LoadBlocker returns a Blocker using the blocklist loaded from blocklists
+// and allowlists, see LoadBlocklist and NewBlocker. Reload loads them again.
+func LoadBlocker(blocklists, allowlists []string, answer string) (*Blocker, error) {
+	list, err := LoadBlocklist(blocklists, allowlists)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewBlocker(list, answer)
+	if err != nil {
+		return nil, err
+	}
+	b.blocklists, b.allowlists = blocklists, allowlists
+	return b, nil
+}
+
+// Reload loads the lists again into a new blocklist and swaps it with the one
+// in use, which is kept if any list fails to load. The queries already being
+// answered keep the previous one.
+func (b *Blocker) Reload() error {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+	if b.blocklists == nil && b.allowlists == nil {
+		return nil
+	}
+	list, err := LoadBlocklist(b.blocklists, b.allowlists)
+	if err != nil {
+		return err
+	}
+	b.list.Store(list)
+	return nil
+}
+
+// String describes the blocklist in use, with its number of rules.
+func (b *Blocker) String() string {
+	blocked, allowed := b.list.Load().Len()
+	return fmt.Sprintf("blocklist of %d blocking and %d allowing rules", blocked, allowed)
+}
+
+// Blocklist returns the blocklist in use.
+func (b *Blocker) Blocklist() *Blocklist {
+	return b.list.Load()
+}
+
+// SetBlocklist replaces the blocklist, the queries being answered keep the
+// previous one.
+func (b *Blocker) SetBlocklist(list *Blocklist) {
+	b.list.Store(list)
+}
+
+// Plugin is the plugin answering the queries for blocked names, the others
+// go to next.
+func (b *Blocker) Plugin(s *Socket, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+		q := r.Questions[0]
+		if q.Class != dnsmessage.ClassINET || !b.list.Load().Blocked(q.Name.String()) {
+			next.ServeDNS(ctx, w, r)
+			return
+		}
+		_, opt := splitOPT(r.Additionals)
+		edns := newClientEDNS(opt, w.Stream(), s.opts.EDNSSize)
+		msg := errorResponse(r.Header, r.Questions, edns, b.rcode, s.opts.EDNSSize)
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: blockedTTL}
+		switch {
+		case q.Type == dnsmessage.TypeA && b.ip4 != nil:
+			msg.Answers = []dnsmessage.Resource{{Header: header, Body: b.ip4}}
+		case q.Type == dnsmessage.TypeAAAA && b.ip6 != nil:
+			msg.Answers = []dnsmessage.Resource{{Header: header, Body: b.ip6}}
+		}
+		if err := w.WriteMsg(&msg); err != nil {
+			s.log.Println(err)
+		}
+	})
+}
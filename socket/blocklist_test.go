@@ -0,0 +1,143 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testBlocklist = `# hosts file
+0.0.0.0 hosts.example tracker.hosts.example
+127.0.0.1 localhost
+::1 ip6-localhost
+plain.example # trailing comment
+! adblock
+[Adblock Plus 2.0]
+||adblock.example^
+||important.example^$important
+||thirdparty.example^$third-party
+@@||ok.adblock.example^
+*.wild.example
+not a valid line
+`
+
+func TestBlocklist(t *testing.T) {
+	list, err := socket.NewBlocklist(
+		[]io.Reader{strings.NewReader(testBlocklist)},
+		[]io.Reader{strings.NewReader("allowed.plain.example\nplain.example\n")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, blocked := range map[string]bool{
+		"hosts.example.":            true,
+		"Tracker.Hosts.Example":     true,
+		"sub.hosts.example.":        false,
+		"localhost.":                false,
+		"plain.example.":            false,
+		"adblock.example.":          true,
+		"a.b.adblock.example.":      true,
+		"ok.adblock.example.":       false,
+		"x.ok.adblock.example.":     false,
+		"important.example.":        true,
+		"thirdparty.example.":       false,
+		"wild.example.":             false,
+		"a.wild.example.":           true,
+		"example.":                  false,
+		"notadblock.example.":       false,
+		"allowed.plain.example.":    false,
+		"tracker.hosts.example.com": false,
+	} {
+		if got := list.Blocked(name); got != blocked {
+			t.Errorf("%s: blocked %v, expected %v", name, got, blocked)
+		}
+	}
+	if blocked, allowed := list.Len(); blocked != 6 || allowed != 3 {
+		t.Errorf("expected 6 blocking and 3 allowing rules, got %d and %d", blocked, allowed)
+	}
+}
+
+func TestBlocker(t *testing.T) {
+	list, err := socket.NewBlocklist([]io.Reader{strings.NewReader("||ads.example^")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := startUpstream(t, nil)
+	for _, tt := range []struct {
+		answer string
+		rcode  dnsmessage.RCode
+		a      string
+		aaaa   string
+	}{
+		{"nxdomain", dnsmessage.RCodeNameError, "", ""},
+		{"null", dnsmessage.RCodeSuccess, "0.0.0.0", "::"},
+		{"10.0.0.1, fd00::1", dnsmessage.RCodeSuccess, "10.0.0.1", "fd00::1"},
+		{"10.0.0.1", dnsmessage.RCodeSuccess, "10.0.0.1", ""},
+	} {
+		blocker, err := socket.NewBlocker(list, tt.answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := servePlugins(t, socket.Options{
+			Upstreams: []string{u.addr},
+			Plugins:   []socket.Plugin{blocker.Plugin, socket.Cache, socket.Forward},
+		})
+		for _, q := range []struct {
+			typ  dnsmessage.Type
+			want string
+		}{{dnsmessage.TypeA, tt.a}, {dnsmessage.TypeAAAA, tt.aaaa}, {dnsmessage.TypeMX, ""}} {
+			resp := exchange(t, addr, newQuery(t, 1, "x.ads.example.", q.typ))
+			if resp.RCode != tt.rcode {
+				t.Errorf("%s %v: expected %v, got %v", tt.answer, q.typ, tt.rcode, resp.RCode)
+			}
+			got := ""
+			if len(resp.Answers) == 1 {
+				switch body := resp.Answers[0].Body.(type) {
+				case *dnsmessage.AResource:
+					got = net.IP(body.A[:]).String()
+				case *dnsmessage.AAAAResource:
+					got = net.IP(body.AAAA[:]).String()
+				}
+			}
+			if got != q.want || len(resp.Answers) > 1 {
+				t.Errorf("%s %v: expected %q, got %+v", tt.answer, q.typ, q.want, resp.Answers)
+			}
+		}
+	}
+	if n := u.queries.Load(); n != 0 {
+		t.Errorf("blocked names should not be forwarded, got %d queries", n)
+	}
+
+	for _, answer := range []string{"bogus", "10.0.0.1,10.0.0.2"} {
+		if _, err := socket.NewBlocker(list, answer); err == nil {
+			t.Errorf("%q should be rejected", answer)
+		}
+	}
+}
+
+func TestBlocklistArgs(t *testing.T) {
+	dir := t.TempDir()
+	blocklist, allowlist := filepath.Join(dir, "block.txt"), filepath.Join(dir, "allow.txt")
+	if err := os.WriteFile(blocklist, []byte("||ads.example^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(allowlist, []byte("ok.ads.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Blocklists: blocklist, Allowlists: allowlist, BlockAnswer: "nxdomain"})
+
+	if resp := exchange(t, s.Addr().String(), newQuery(t, 1, "ads.example.", dnsmessage.TypeA)); resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("ads.example. should be blocked: %+v", resp)
+	}
+	if resp := exchange(t, s.Addr().String(), newQuery(t, 2, "ok.ads.example.", dnsmessage.TypeA)); len(resp.Answers) != 1 {
+		t.Errorf("ok.ads.example. should be allowed: %+v", resp)
+	}
+}
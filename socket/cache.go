@@ -0,0 +1,243 @@
+package socket
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type (
+	// cacheKey identifies a cached response. Responses to queries with the
+	// DO bit may hold DNSSEC records the others must not get, and the ones
+	// to queries with the CD bit may hold data that failed validation.
+	cacheKey struct {
+		question         dnsmessage.Question
+		dnssecOK         bool
+		checkingDisabled bool
+	}
+
+	// cacheEntry is a cached response along with the time it was stored at,
+	// it stays valid for ttl seconds after that.
+	cacheEntry struct {
+		header      dnsmessage.Header
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		additionals []dnsmessage.Resource
+		// opt is the EDNS0 record of the response, it's kept apart as its
+		// ttl holds flags and it's only sent back to clients using EDNS0
+		opt    *dnsmessage.Resource
+		stored time.Time
+		ttl    uint32
+	}
+
+	// cachePolicy bounds how long responses are kept in the cache, a zero
+	// maximum means no limit.
+	cachePolicy struct {
+		minTTL         time.Duration
+		maxTTL         time.Duration
+		maxNegativeTTL time.Duration
+	}
+)
+
+// newCacheEntry makes a cache entry for a response. Positive responses live
+// as long as their smallest ttl, negative ones (NXDOMAIN and NODATA) as long
+// as their SOA says (RFC 2308), both clamped by p.
+// It returns nil when the response shouldn't be cached at all.
+func newCacheEntry(msg *dnsmessage.Message, now time.Time, p cachePolicy) *cacheEntry {
+	if msg.Truncated {
+		return nil
+	}
+	negative := len(msg.Answers) == 0
+	switch {
+	case msg.RCode == dnsmessage.RCodeSuccess && !negative:
+	case msg.RCode == dnsmessage.RCodeSuccess, msg.RCode == dnsmessage.RCodeNameError:
+		negative = true
+		if !hasSOA(msg.Authorities) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	maxTTL := p.maxTTL
+	if negative {
+		maxTTL = p.maxNegativeTTL
+	}
+	additionals, opt := splitOPT(msg.Additionals)
+	e := &cacheEntry{
+		header:      msg.Header,
+		answers:     clampResources(msg.Answers, p.minTTL, maxTTL),
+		authorities: clampResources(msg.Authorities, p.minTTL, maxTTL),
+		additionals: clampResources(additionals, p.minTTL, maxTTL),
+		opt:         opt,
+		stored:      now,
+	}
+
+	first := true
+	for _, rs := range [][]dnsmessage.Resource{e.answers, e.authorities, e.additionals} {
+		for _, r := range rs {
+			if first || r.Header.TTL < e.ttl {
+				e.ttl = r.Header.TTL
+				first = false
+			}
+		}
+	}
+	if e.ttl == 0 {
+		return nil
+	}
+	return e
+}
+
+func hasSOA(rs []dnsmessage.Resource) bool {
+	for _, r := range rs {
+		if r.Header.Type == dnsmessage.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+// clampResources returns a copy of rs with their ttl clamped. The ttl of a SOA
+// record is also lowered to its minimum field, which is the ttl of the
+// negative answer it came with.
+func clampResources(rs []dnsmessage.Resource, minTTL, maxTTL time.Duration) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	clamped := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		clamped[i] = r
+		ttl := r.Header.TTL
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok && soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		clamped[i].Header.TTL = clampTTL(ttl, minTTL, maxTTL)
+	}
+	return clamped
+}
+
+func clampTTL(ttl uint32, minTTL, maxTTL time.Duration) uint32 {
+	if min := uint32(minTTL / time.Second); ttl < min {
+		ttl = min
+	}
+	if max := uint32(maxTTL / time.Second); max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// elapsed returns the whole seconds passed since e was stored and whether e
+// is still valid at now.
+func (e *cacheEntry) elapsed(now time.Time) (uint32, bool) {
+	d := now.Sub(e.stored)
+	if d < 0 {
+		d = 0
+	}
+	elapsed := uint32(d / time.Second)
+	return elapsed, elapsed < e.ttl
+}
+
+// message returns the cached response with the ttl of its records decremented
+// by the time they spent in the cache. elapsed must be smaller than e.ttl.
+// The OPT record isn't included, see ednsReply.
+func (e *cacheEntry) message(elapsed uint32) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:      e.header,
+		Answers:     decrementTTL(e.answers, elapsed),
+		Authorities: decrementTTL(e.authorities, elapsed),
+		Additionals: decrementTTL(e.additionals, elapsed),
+	}
+}
+
+// decrementTTL returns a copy of rs with elapsed taken off their ttl, which
+// are all bigger than elapsed as e.ttl is the smallest of them.
+func decrementTTL(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	decremented := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		decremented[i] = r
+		decremented[i].Header.TTL = r.Header.TTL - elapsed
+	}
+	return decremented
+}
+
+// cacheGet returns the response cached for q with the remaining ttl and the
+// OPT record it came with, expired entries are removed from the cache.
+func (s *Socket) cacheGet(q cacheKey) (dnsmessage.Message, *dnsmessage.Resource, bool) {
+	e, ok := s.cache.Get(q)
+	if !ok {
+		return dnsmessage.Message{}, nil, false
+	}
+	elapsed, ok := e.elapsed(time.Now())
+	if !ok {
+		s.cache.Remove(q)
+		return dnsmessage.Message{}, nil, false
+	}
+	return e.message(elapsed), e.opt, true
+}
+
+// cacheAdd caches a response for q, unless its rcode or ttl, or the forward
+// rule of its name, says otherwise.
+func (s *Socket) cacheAdd(q cacheKey, msg *dnsmessage.Message) {
+	g := s.route(q.question.Name.String())
+	if g.noCache {
+		return
+	}
+	if e := newCacheEntry(msg, time.Now(), g.policy); e != nil {
+		s.cache.Add(q, e)
+	}
+}
+
+// Cache is the plugin answering the queries from the cache, the responses of
+// the next plugins are cached.
+func Cache(s *Socket, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+		_, queryOPT := splitOPT(r.Additionals)
+		edns := newClientEDNS(queryOPT, w.Stream(), s.opts.EDNSSize)
+		key := cacheKey{
+			question:         r.Questions[0],
+			dnssecOK:         edns.dnssecOK,
+			checkingDisabled: r.CheckingDisabled,
+		}
+		if msg, opt, ok := s.cacheGet(key); ok {
+			s.metrics.cacheRequests.inc("hit")
+			if info := queryInfoFrom(ctx); info != nil {
+				info.cacheHit = true
+			}
+			// the flags describing the query are the client's, not the ones
+			// of the query the response was cached for
+			msg.ID = r.ID
+			msg.OpCode = r.OpCode
+			msg.RecursionDesired = r.RecursionDesired
+			msg.CheckingDisabled = r.CheckingDisabled
+			msg.Questions = r.Questions
+			if edns.opt != nil {
+				msg.Additionals = append(msg.Additionals, ednsReply(opt, msg.RCode, s.opts.EDNSSize, edns.dnssecOK))
+			}
+			if err := w.WriteMsg(&msg); err != nil {
+				s.log.Println(err)
+			}
+			return
+		}
+
+		s.metrics.cacheRequests.inc("miss")
+		rec := NewRecorder(w)
+		next.ServeDNS(ctx, rec, r)
+		if rec.Msg == nil {
+			return
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(rec.Msg); err != nil {
+			s.log.Println(err)
+			return
+		}
+		// the next plugins may answer another question than the query's
+		if len(resp.Questions) != 1 || !sameQuestion(resp.Questions[0], key.question) {
+			return
+		}
+		s.cacheAdd(key, &resp)
+	})
+}
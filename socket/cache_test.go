@@ -0,0 +1,158 @@
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testAnswers(ttls ...uint32) []dnsmessage.Resource {
+	rs := make([]dnsmessage.Resource, len(ttls))
+	for i, ttl := range ttls {
+		rs[i] = dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, byte(i)}},
+		}
+	}
+	return rs
+}
+
+func testSOA(ttl, minTTL uint32) []dnsmessage.Resource {
+	return []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example.com."),
+			MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+			MinTTL: minTTL,
+		},
+	}}
+}
+
+func testMsg(rcode dnsmessage.RCode, answers, authorities []dnsmessage.Resource) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: rcode},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+}
+
+func TestCacheEntryExpiry(t *testing.T) {
+	now := time.Now()
+	e := newCacheEntry(testMsg(dnsmessage.RCodeSuccess, testAnswers(300, 60), nil), now, cachePolicy{})
+	if e == nil || e.ttl != 60 {
+		t.Fatalf("entry should live for the smallest ttl: %+v", e)
+	}
+
+	elapsed, ok := e.elapsed(now.Add(45 * time.Second))
+	if !ok || elapsed != 45 {
+		t.Fatalf("entry should be valid after 45s: %v, %v", elapsed, ok)
+	}
+	rs := e.message(elapsed).Answers
+	if rs[0].Header.TTL != 255 || rs[1].Header.TTL != 15 {
+		t.Errorf("ttls not decremented: %d, %d", rs[0].Header.TTL, rs[1].Header.TTL)
+	}
+	if e.answers[0].Header.TTL != 300 {
+		t.Errorf("cached answers should not be modified")
+	}
+
+	if _, ok := e.elapsed(now.Add(60 * time.Second)); ok {
+		t.Errorf("entry should be expired after 60s")
+	}
+}
+
+func TestCacheEntryClamp(t *testing.T) {
+	now := time.Now()
+	if e := newCacheEntry(testMsg(dnsmessage.RCodeSuccess, testAnswers(0), nil), now, cachePolicy{}); e != nil {
+		t.Errorf("zero ttl answers should not be cached")
+	}
+
+	p := cachePolicy{minTTL: 30 * time.Second, maxTTL: time.Hour}
+	e := newCacheEntry(testMsg(dnsmessage.RCodeSuccess, testAnswers(5), nil), now, p)
+	if e == nil || e.ttl != 30 {
+		t.Fatalf("ttl should be raised to the minimum: %+v", e)
+	}
+	if rs := e.message(10).Answers; rs[0].Header.TTL != 20 {
+		t.Errorf("bad ttl: %d", rs[0].Header.TTL)
+	}
+
+	e = newCacheEntry(testMsg(dnsmessage.RCodeSuccess, testAnswers(86400*7), nil), now, p)
+	if e == nil || e.ttl != 3600 {
+		t.Fatalf("ttl should be lowered to the maximum: %+v", e)
+	}
+}
+
+func TestCacheEntryNegative(t *testing.T) {
+	now := time.Now()
+	p := cachePolicy{maxTTL: 24 * time.Hour, maxNegativeTTL: 10 * time.Minute}
+
+	if e := newCacheEntry(testMsg(dnsmessage.RCodeNameError, nil, nil), now, p); e != nil {
+		t.Errorf("negative answers without SOA should not be cached")
+	}
+	if e := newCacheEntry(testMsg(dnsmessage.RCodeServerFailure, nil, testSOA(300, 300)), now, p); e != nil {
+		t.Errorf("server failures should not be cached")
+	}
+
+	// the SOA minimum is smaller than its ttl
+	e := newCacheEntry(testMsg(dnsmessage.RCodeNameError, nil, testSOA(3600, 120)), now, p)
+	if e == nil || e.ttl != 120 {
+		t.Fatalf("nxdomain should live for the SOA minimum: %+v", e)
+	}
+	msg := e.message(20)
+	if msg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("rcode not preserved: %v", msg.RCode)
+	}
+	if len(msg.Authorities) != 1 || msg.Authorities[0].Header.TTL != 100 {
+		t.Errorf("bad authorities: %+v", msg.Authorities)
+	}
+
+	// nodata, capped by the negative maximum
+	e = newCacheEntry(testMsg(dnsmessage.RCodeSuccess, nil, testSOA(86400, 86400)), now, p)
+	if e == nil || e.ttl != 600 {
+		t.Fatalf("nodata should be capped by the negative maximum: %+v", e)
+	}
+	if msg := e.message(0); msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("bad nodata message: %+v", msg)
+	}
+}
+
+func TestCacheEntrySections(t *testing.T) {
+	msg := testMsg(dnsmessage.RCodeSuccess, testAnswers(300), nil)
+	msg.RecursionAvailable = true
+	msg.AuthenticData = true
+	msg.Additionals = append(testAnswers(120), dnsmessage.Resource{Body: &dnsmessage.OPTResource{}})
+	if err := msg.Additionals[1].Header.SetEDNS0(1232, dnsmessage.RCodeSuccess, true); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newCacheEntry(msg, time.Now(), cachePolicy{})
+	if e == nil || e.ttl != 120 {
+		t.Fatalf("additional records should count for the ttl: %+v", e)
+	}
+	if e.opt == nil || !e.opt.Header.DNSSECAllowed() {
+		t.Fatalf("OPT record should be kept apart: %+v", e.opt)
+	}
+
+	cached := e.message(100)
+	if !cached.RecursionAvailable || !cached.AuthenticData || !cached.Response {
+		t.Errorf("header flags not preserved: %+v", cached.Header)
+	}
+	if len(cached.Additionals) != 1 || cached.Additionals[0].Header.TTL != 20 {
+		t.Errorf("bad additionals: %+v", cached.Additionals)
+	}
+
+	msg.Truncated = true
+	if e := newCacheEntry(msg, time.Now(), cachePolicy{}); e != nil {
+		t.Errorf("truncated responses should not be cached")
+	}
+}
@@ -0,0 +1,201 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type (
+	// ForwardRule sends the queries for a zone to dedicated upstreams, the
+	// rule of the longest zone matching a name applies to it.
+	ForwardRule struct {
+		// Zone is the domain the rule applies to, along with its subdomains:
+		// a name like corp.example, a reverse zone like 10.in-addr.arpa, or
+		// a network like 10.0.0.0/8 standing for its reverse zone
+		Zone string
+		// Upstreams are where the queries are forwarded to, in the format
+		// of Options.Upstreams
+		Upstreams []string
+		// Strategy picks the upstream order, the one of the options if empty
+		Strategy string
+		// Timeout bounds each exchange, the UpstreamTimeout of the options
+		// if zero
+		Timeout time.Duration
+		// NoCache keeps the responses out of the cache. Otherwise the cache
+		// ttls of the options are used, unless they are overridden by the
+		// non zero ones of the rule
+		NoCache        bool
+		MinCacheTTL    time.Duration
+		MaxCacheTTL    time.Duration
+		MaxNegativeTTL time.Duration
+	}
+
+	// upstreamGroup is a set of upstreams, and how the responses they give
+	// are cached.
+	upstreamGroup struct {
+		zone      string
+		upstreams []*Upstream
+		strategy  Strategy
+		noCache   bool
+		policy    cachePolicy
+	}
+)
+
+// ParseForwardRule parses a rule of the command line:
+//
+//	zone=upstream[,upstream...][;option...]
+//
+// The options are timeout=duration, strategy=name, cache=off,
+// mincachettl=duration, maxcachettl=duration and maxnegttl=duration.
+func ParseForwardRule(s string) (ForwardRule, error) {
+	var rule ForwardRule
+	fields := strings.Split(s, ";")
+	zone, upstreams, ok := strings.Cut(fields[0], "=")
+	if !ok || zone == "" || upstreams == "" {
+		return rule, fmt.Errorf("invalid forward rule %q: expected zone=upstreams", s)
+	}
+	rule.Zone, rule.Upstreams = strings.TrimSpace(zone), strings.Split(upstreams, ",")
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		var (
+			d   *time.Duration
+			err error
+		)
+		switch key {
+		case "timeout":
+			d = &rule.Timeout
+		case "mincachettl":
+			d = &rule.MinCacheTTL
+		case "maxcachettl":
+			d = &rule.MaxCacheTTL
+		case "maxnegttl":
+			d = &rule.MaxNegativeTTL
+		case "strategy":
+			rule.Strategy = value
+		case "cache":
+			if value != "on" && value != "off" {
+				return rule, fmt.Errorf("invalid forward rule %q: cache is on or off", s)
+			}
+			rule.NoCache = value == "off"
+		default:
+			return rule, fmt.Errorf("invalid forward rule %q: unknown option %q", s, key)
+		}
+		if d != nil {
+			if *d, err = time.ParseDuration(value); err != nil || *d < 0 {
+				return rule, fmt.Errorf("invalid forward rule %q: invalid %s", s, key)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// newUpstreamGroups returns the groups of the rules by lower case zone, along
+// with the default group of the options for the root zone unless a rule is
+// given for it. It also returns all their upstreams.
+func newUpstreamGroups(opts Options) (map[string]*upstreamGroup, []*Upstream, error) {
+	upstreams, err := parseUpstreams(opts.Upstreams, opts.UpstreamTimeout, opts.UpstreamConns, opts.Logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	strategy, err := NewStrategy(opts.Strategy)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := cachePolicy{
+		minTTL:         opts.MinCacheTTL,
+		maxTTL:         opts.MaxCacheTTL,
+		maxNegativeTTL: opts.MaxNegativeTTL,
+	}
+	groups := map[string]*upstreamGroup{
+		".": {zone: ".", upstreams: upstreams, strategy: strategy, policy: policy},
+	}
+	all := upstreams
+
+	ruled := make(map[string]bool)
+	for _, rule := range opts.ForwardRules {
+		zone, err := ruleZone(rule.Zone)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ruled[zone] {
+			return nil, nil, fmt.Errorf("several forward rules for %s", zone)
+		}
+		ruled[zone] = true
+
+		timeout := rule.Timeout
+		if timeout <= 0 {
+			timeout = opts.UpstreamTimeout
+		}
+		upstreams, err := parseUpstreams(rule.Upstreams, timeout, opts.UpstreamConns, opts.Logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("forward rule for %s: %w", zone, err)
+		}
+		name := rule.Strategy
+		if name == "" {
+			name = opts.Strategy
+		}
+		strategy, err := NewStrategy(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("forward rule for %s: %w", zone, err)
+		}
+		g := &upstreamGroup{zone: zone, upstreams: upstreams, strategy: strategy, noCache: rule.NoCache, policy: policy}
+		if rule.MinCacheTTL > 0 {
+			g.policy.minTTL = rule.MinCacheTTL
+		}
+		if rule.MaxCacheTTL > 0 {
+			g.policy.maxTTL = rule.MaxCacheTTL
+		}
+		if rule.MaxNegativeTTL > 0 {
+			g.policy.maxNegativeTTL = rule.MaxNegativeTTL
+		}
+		groups[zone] = g
+		all = append(all, upstreams...)
+	}
+	return groups, all, nil
+}
+
+// ruleZone returns the lower case fully qualified zone of a rule, the
+// reverse zone of a network.
+func ruleZone(zone string) (string, error) {
+	zone = strings.TrimSpace(zone)
+	if _, network, err := net.ParseCIDR(zone); err == nil {
+		return reverseZone(network)
+	}
+	if zone == "." {
+		return zone, nil
+	}
+	name, ok := normalizeDomain(zone)
+	if !ok {
+		return "", fmt.Errorf("invalid forward rule zone %q", zone)
+	}
+	return name, nil
+}
+
+// reverseZone returns the in-addr.arpa or ip6.arpa zone of a network, whose
+// prefix ends on an octet for ipv4 and on a nibble for ipv6.
+func reverseZone(network *net.IPNet) (string, error) {
+	ones, bits := network.Mask.Size()
+	labelBits := 8
+	if bits == 128 {
+		labelBits = 4
+	}
+	if ones%labelBits != 0 {
+		return "", fmt.Errorf("network %s is not on a reverse zone boundary", network)
+	}
+	labels := strings.Split(reverseName(network.IP), ".")
+	return strings.Join(labels[(bits-ones)/labelBits:], "."), nil
+}
+
+// route returns the group of the longest zone matching name.
+func (s *Socket) route(name string) *upstreamGroup {
+	for suffix := strings.ToLower(fqdn(name)); ; {
+		if g, ok := s.groups[suffix]; ok {
+			return g
+		}
+		if _, suffix, _ = strings.Cut(suffix, "."); suffix == "" {
+			suffix = "."
+		}
+	}
+}
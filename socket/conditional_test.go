@@ -0,0 +1,173 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestForwardRules(t *testing.T) {
+	public := startUpstream(t, answerA([4]byte{1, 2, 3, 4}, 300))
+	corp := startUpstream(t, answerA([4]byte{10, 0, 0, 1}, 300))
+	eng := startUpstream(t, answerA([4]byte{10, 0, 0, 2}, 300))
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{public.addr},
+		ForwardRules: []socket.ForwardRule{
+			{Zone: "corp.example", Upstreams: []string{corp.addr}},
+			{Zone: "eng.corp.example.", Upstreams: []string{eng.addr}},
+			{Zone: "10.0.0.0/8", Upstreams: []string{corp.addr}},
+			{Zone: "168.192.in-addr.arpa", Upstreams: []string{eng.addr}},
+		},
+	})
+
+	for _, tt := range []struct {
+		name string
+		typ  dnsmessage.Type
+		u    *fakeUpstream
+	}{
+		{"corp.example.", dnsmessage.TypeA, corp},
+		{"Host.Corp.Example.", dnsmessage.TypeA, corp},
+		{"eng.corp.example.", dnsmessage.TypeA, eng},
+		{"build.eng.corp.example.", dnsmessage.TypeA, eng},
+		{"xeng.corp.example.", dnsmessage.TypeA, corp},
+		{"notcorp.example.", dnsmessage.TypeA, public},
+		{"example.", dnsmessage.TypeA, public},
+		{"5.0.0.10.in-addr.arpa.", dnsmessage.TypePTR, corp},
+		{"1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, eng},
+		{"1.1.1.1.in-addr.arpa.", dnsmessage.TypePTR, public},
+	} {
+		before := tt.u.queries.Load()
+		exchange(t, addr, newQuery(t, 1, tt.name, tt.typ))
+		if tt.u.queries.Load() != before+1 {
+			t.Errorf("%s should be forwarded to %s", tt.name, tt.u.addr)
+		}
+	}
+	if n := public.queries.Load() + corp.queries.Load() + eng.queries.Load(); n != 10 {
+		t.Errorf("expected 10 queries forwarded, got %d", n)
+	}
+}
+
+func TestForwardRuleCache(t *testing.T) {
+	public := startUpstream(t, answerA([4]byte{1, 2, 3, 4}, 300))
+	nocache := startUpstream(t, answerA([4]byte{10, 0, 0, 1}, 300))
+	short := startUpstream(t, answerA([4]byte{10, 0, 0, 2}, 300))
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{public.addr},
+		ForwardRules: []socket.ForwardRule{
+			{Zone: "nocache.example", Upstreams: []string{nocache.addr}, NoCache: true},
+			{Zone: "short.example", Upstreams: []string{short.addr}, MaxCacheTTL: time.Minute},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"a.example.", "a.nocache.example.", "a.short.example."} {
+			exchange(t, addr, newQuery(t, 1, name, dnsmessage.TypeA))
+		}
+	}
+	if n := public.queries.Load(); n != 1 {
+		t.Errorf("the default group should be cached, got %d queries", n)
+	}
+	if n := nocache.queries.Load(); n != 2 {
+		t.Errorf("the responses of a rule without cache should not be cached, got %d queries", n)
+	}
+	if n := short.queries.Load(); n != 1 {
+		t.Errorf("the responses of a rule with a cache policy should be cached, got %d queries", n)
+	}
+	resp := exchange(t, addr, newQuery(t, 1, "a.short.example.", dnsmessage.TypeA))
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL > 60 {
+		t.Errorf("the ttl should be capped by the rule: %+v", resp.Answers)
+	}
+	resp = exchange(t, addr, newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL <= 60 {
+		t.Errorf("the ttl of the default group should not be capped: %+v", resp.Answers)
+	}
+}
+
+func TestForwardRuleTimeout(t *testing.T) {
+	public := startUpstream(t, nil)
+	slow := startUpstream(t, nil)
+	slow.drop.Store(100)
+	addr := servePlugins(t, socket.Options{
+		Upstreams:       []string{public.addr},
+		UpstreamTimeout: 5 * time.Second,
+		ForwardRules: []socket.ForwardRule{
+			{Zone: "slow.example", Upstreams: []string{slow.addr}, Timeout: 50 * time.Millisecond},
+		},
+	})
+
+	start := time.Now()
+	resp := exchange(t, addr, newQuery(t, 1, "a.slow.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", resp.RCode)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the timeout of the rule should apply, took %v", d)
+	}
+}
+
+func TestParseForwardRule(t *testing.T) {
+	rule, err := socket.ParseForwardRule("corp.example=10.0.0.53,10.0.0.54:5353;timeout=500ms;strategy=roundrobin;cache=off;maxnegttl=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := socket.ForwardRule{
+		Zone:           "corp.example",
+		Upstreams:      []string{"10.0.0.53", "10.0.0.54:5353"},
+		Strategy:       "roundrobin",
+		Timeout:        500 * time.Millisecond,
+		NoCache:        true,
+		MaxNegativeTTL: time.Minute,
+	}
+	if !reflect.DeepEqual(rule, want) {
+		t.Errorf("expected %+v, got %+v", want, rule)
+	}
+
+	for _, s := range []string{
+		"corp.example", "=10.0.0.53", "corp.example=", "corp.example=10.0.0.53;timeout=soon",
+		"corp.example=10.0.0.53;cache=maybe", "corp.example=10.0.0.53;bogus=1",
+	} {
+		if _, err := socket.ParseForwardRule(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+
+	for _, zone := range []string{"10.0.0.0/12", "fd00::/10", "bad zone", "a..example"} {
+		_, err := socket.New(socket.Options{
+			Upstreams:    []string{"127.0.0.1:1"},
+			ForwardRules: []socket.ForwardRule{{Zone: zone, Upstreams: []string{"127.0.0.1:1"}}},
+		})
+		if err == nil {
+			t.Errorf("zone %q should be rejected", zone)
+		}
+	}
+	_, err = socket.New(socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		ForwardRules: []socket.ForwardRule{
+			{Zone: "10.in-addr.arpa", Upstreams: []string{"127.0.0.1:1"}},
+			{Zone: "10.0.0.0/8", Upstreams: []string{"127.0.0.1:2"}},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "10.in-addr.arpa.") {
+		t.Errorf("rules for the same zone should be rejected, got %v", err)
+	}
+}
+
+func TestForwardRuleArgs(t *testing.T) {
+	public := startUpstream(t, nil)
+	corp := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:      public.addr,
+		ForwardRules: args.List{"corp.example=" + corp.addr + ";timeout=1s", "fd00::/16=" + corp.addr},
+	})
+	exchange(t, s.Addr().String(), newQuery(t, 1, "host.corp.example.", dnsmessage.TypeA))
+	exchange(t, s.Addr().String(), newQuery(t, 2, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dnsmessage.TypePTR))
+	exchange(t, s.Addr().String(), newQuery(t, 3, "host.example.", dnsmessage.TypeA))
+	if corp.queries.Load() != 2 || public.queries.Load() != 1 {
+		t.Errorf("expected 2 queries to the rule upstream and 1 to the default one, got %d and %d", corp.queries.Load(), public.queries.Load())
+	}
+}
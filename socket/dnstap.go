@@ -0,0 +1,644 @@
+package socket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dnstapContentType is the frame streams content type of dnstap
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	// dnstapQueueSize is the number of frames waiting to be written, the
+	// next ones are dropped
+	dnstapQueueSize = 1024
+	// maxFrameSize bounds the frames read back
+	maxFrameSize = 1 << 20
+	// dnstapTimeout bounds the handshake with a dnstap collector
+	dnstapTimeout = 5 * time.Second
+
+	// frame streams control frames and fields
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmStop        = 3
+	fstrmReady       = 4
+	fstrmFinish      = 5
+	fstrmContentType = 1
+)
+
+// DnstapType is the type of a dnstap message, the ones sent by the server are
+// the client and forwarder ones.
+type DnstapType uint64
+
+const (
+	DnstapClientQuery       DnstapType = 5
+	DnstapClientResponse    DnstapType = 6
+	DnstapForwarderQuery    DnstapType = 7
+	DnstapForwarderResponse DnstapType = 8
+)
+
+func (t DnstapType) String() string {
+	switch t {
+	case DnstapClientQuery:
+		return "CLIENT_QUERY"
+	case DnstapClientResponse:
+		return "CLIENT_RESPONSE"
+	case DnstapForwarderQuery:
+		return "FORWARDER_QUERY"
+	case DnstapForwarderResponse:
+		return "FORWARDER_RESPONSE"
+	}
+	return fmt.Sprintf("DnstapType(%d)", uint64(t))
+}
+
+// dnstap socket protocols, by the names of the transports in the metrics
+var dnstapProtocols = map[string]uint64{
+	"udp":   1,
+	"tcp":   2,
+	"tls":   3,
+	"https": 4,
+}
+
+type (
+	// DnstapMessage is a dnstap message (https://dnstap.info), with the
+	// fields the server fills. The query address is the client's for client
+	// messages, the response address is the upstream's for forwarder ones.
+	DnstapMessage struct {
+		Identity []byte
+		Version  []byte
+		Type     DnstapType
+		// Protocol is udp, tcp, tls or https, empty if unknown
+		Protocol        string
+		QueryAddress    net.IP
+		QueryPort       uint32
+		ResponseAddress net.IP
+		ResponsePort    uint32
+		QueryTime       time.Time
+		ResponseTime    time.Time
+		// QueryMessage and ResponseMessage are the packed dns messages, nil
+		// when the wire messages are omitted
+		QueryMessage    []byte
+		ResponseMessage []byte
+	}
+
+	// DnstapOptions configures a Dnstap.
+	DnstapOptions struct {
+		// Identity and Version are sent in every message, usually the host
+		// name and the server version
+		Identity string
+		Version  string
+		// Wire includes the dns messages, only their metadata is sent if
+		// false
+		Wire bool
+		// Logger gets the write error after which the messages are dropped,
+		// the standard logger if nil
+		Logger Logger
+	}
+
+	// Dnstap writes dnstap messages over frame streams. They are written in
+	// the background, and dropped when the writer can't keep up.
+	Dnstap struct {
+		opts   DnstapOptions
+		w      *bufio.Writer
+		closer io.Closer
+		// conn is set for the bidirectional streams of unix sockets
+		conn net.Conn
+
+		mu      sync.RWMutex
+		closed  bool
+		frames  chan []byte
+		done    chan struct{}
+		err     error
+		dropped atomic.Uint64
+	}
+
+	// DnstapReader reads back the messages of a unidirectional frame
+	// stream, as written to a file.
+	DnstapReader struct {
+		r *bufio.Reader
+	}
+)
+
+// NewDnstap returns a Dnstap writing a unidirectional frame stream to w, it
+// doesn't close w.
+func NewDnstap(w io.Writer, opts DnstapOptions) (*Dnstap, error) {
+	return newDnstap(w, nil, nil, opts)
+}
+
+// OpenDnstap opens the destination of the dnstap messages: unix:path for a
+// dnstap collector listening on a unix socket, with which the bidirectional
+// frame streams handshake is done, or the path of a file, which is truncated.
+func OpenDnstap(dest string, opts DnstapOptions) (*Dnstap, error) {
+	if strings.HasPrefix(dest, "unix:") {
+		path := strings.TrimPrefix(dest, "unix:")
+		conn, err := net.DialTimeout("unix", path, dnstapTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := fstrmHandshake(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dnstap handshake with %s: %w", path, err)
+		}
+		return newDnstap(conn, conn, conn, opts)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return nil, err
+	}
+	return newDnstap(f, f, nil, opts)
+}
+
+func newDnstap(w io.Writer, closer io.Closer, conn net.Conn, opts DnstapOptions) (*Dnstap, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	d := &Dnstap{
+		opts:   opts,
+		w:      bufio.NewWriter(w),
+		closer: closer,
+		conn:   conn,
+		frames: make(chan []byte, dnstapQueueSize),
+		done:   make(chan struct{}),
+	}
+	err := writeControl(d.w, fstrmStart, dnstapContentType)
+	if err == nil {
+		err = d.w.Flush()
+	}
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	go d.writer()
+	return d, nil
+}
+
+// fstrmHandshake sends READY to a collector and waits for its ACCEPT.
+func fstrmHandshake(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(dnstapTimeout)); err != nil {
+		return err
+	}
+	if err := writeControl(conn, fstrmReady, dnstapContentType); err != nil {
+		return err
+	}
+	typ, contentTypes, err := readControl(conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmAccept {
+		return fmt.Errorf("unexpected control frame %d", typ)
+	}
+	if len(contentTypes) > 0 && !containsString(contentTypes, dnstapContentType) {
+		return fmt.Errorf("content type %s not accepted", dnstapContentType)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writer writes the queued frames, flushing whenever the queue is empty. The
+// frames are dropped once a write fails, the error is returned by Close.
+func (d *Dnstap) writer() {
+	defer close(d.done)
+	// buffered counts the frames not flushed yet, lost on a write error. The
+	// buffer is flushed before a frame not fitting in it, so that it's not
+	// flushed on its own with frames not counted out of it
+	var buffered uint64
+	for frame := range d.frames {
+		if d.err != nil {
+			d.dropped.Add(1)
+			continue
+		}
+		buffered++
+		if d.w.Buffered() > 0 && 4+len(frame) > d.w.Available() {
+			if d.err = d.w.Flush(); d.err == nil {
+				buffered = 1
+			}
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+		if d.err == nil {
+			if _, d.err = d.w.Write(size[:]); d.err == nil {
+				_, d.err = d.w.Write(frame)
+			}
+		}
+		if d.err == nil && len(d.frames) == 0 {
+			if d.err = d.w.Flush(); d.err == nil {
+				buffered = 0
+			}
+		}
+		if d.err != nil {
+			d.dropped.Add(buffered)
+			d.opts.Logger.Printf("dnstap: %v, dropping the next messages\n", d.err)
+		}
+	}
+}
+
+// Log queues m, unless the queue is full or d is closed.
+func (d *Dnstap) Log(m *DnstapMessage) {
+	if !d.opts.Wire {
+		m.QueryMessage, m.ResponseMessage = nil, nil
+	}
+	m.Identity, m.Version = []byte(d.opts.Identity), []byte(d.opts.Version)
+	frame := m.marshal()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		d.dropped.Add(1)
+		return
+	}
+	select {
+	case d.frames <- frame:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of messages dropped as the queue was full, or
+// after a write error.
+func (d *Dnstap) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Close writes the queued messages and ends the stream, waiting for the
+// collector to acknowledge it, then closes the file or the connection.
+func (d *Dnstap) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.frames)
+	d.mu.Unlock()
+	<-d.done
+
+	err := d.err
+	if err == nil {
+		err = writeControl(d.w, fstrmStop, "")
+	}
+	if err == nil {
+		err = d.w.Flush()
+	}
+	if err == nil && d.conn != nil {
+		if err = d.conn.SetReadDeadline(time.Now().Add(dnstapTimeout)); err == nil {
+			var typ uint32
+			if typ, _, err = readControl(d.conn); err == nil && typ != fstrmFinish {
+				err = fmt.Errorf("unexpected control frame %d", typ)
+			}
+		}
+	}
+	if d.closer != nil {
+		if cerr := d.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writeControl writes a control frame, with a content type field if it's not
+// empty.
+func writeControl(w io.Writer, typ uint32, contentType string) error {
+	frame := make([]byte, 12, 20+len(contentType))
+	frame = binary.BigEndian.AppendUint32(frame[:8], typ)
+	if contentType != "" {
+		frame = binary.BigEndian.AppendUint32(frame, fstrmContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(contentType)))
+		frame = append(frame, contentType...)
+	}
+	// the escape is followed by the length of the control frame
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+	_, err := w.Write(frame)
+	return err
+}
+
+// readControl reads a control frame, escape included, and returns its type
+// and content types.
+func readControl(r io.Reader) (uint32, []string, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, nil, errors.New("expected a control frame")
+	}
+	return readControlBody(r, binary.BigEndian.Uint32(header[4:]))
+}
+
+// readControlBody reads the control frame of size bytes following an escape.
+func readControlBody(r io.Reader, size uint32) (uint32, []string, error) {
+	if size < 4 || size > maxFrameSize {
+		return 0, nil, fmt.Errorf("invalid control frame size %d", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	typ := binary.BigEndian.Uint32(frame)
+	var contentTypes []string
+	for fields := frame[4:]; len(fields) > 0; {
+		if len(fields) < 8 {
+			return 0, nil, errors.New("truncated control field")
+		}
+		field, n := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		if uint32(len(fields)-8) < n {
+			return 0, nil, errors.New("truncated control field")
+		}
+		if field == fstrmContentType {
+			contentTypes = append(contentTypes, string(fields[8:8+n]))
+		}
+		fields = fields[8+n:]
+	}
+	return typ, contentTypes, nil
+}
+
+// NewDnstapReader reads the start of a frame stream from r.
+func NewDnstapReader(r io.Reader) (*DnstapReader, error) {
+	br := bufio.NewReader(r)
+	typ, contentTypes, err := readControl(br)
+	if err != nil {
+		return nil, err
+	}
+	if typ != fstrmStart {
+		return nil, fmt.Errorf("unexpected control frame %d", typ)
+	}
+	if len(contentTypes) > 0 && contentTypes[0] != dnstapContentType {
+		return nil, fmt.Errorf("unexpected content type %q", contentTypes[0])
+	}
+	return &DnstapReader{r: br}, nil
+}
+
+// Next returns the next message, io.EOF once the stream is stopped.
+func (r *DnstapReader) Next() (*DnstapMessage, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 {
+		if _, err := io.ReadFull(r.r, size[:]); err != nil {
+			return nil, err
+		}
+		typ, _, err := readControlBody(r.r, binary.BigEndian.Uint32(size[:]))
+		if err != nil {
+			return nil, err
+		}
+		if typ != fstrmStop {
+			return nil, fmt.Errorf("unexpected control frame %d", typ)
+		}
+		return nil, io.EOF
+	}
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		return nil, err
+	}
+	return unmarshalDnstap(frame)
+}
+
+// the fields of the dnstap protobuf messages
+const (
+	dnstapIdentity = 1
+	dnstapVersion  = 2
+	dnstapMessage  = 14
+	dnstapType     = 15
+	// dnstapTypeMessage is the type of the Dnstap messages holding a Message
+	dnstapTypeMessage = 1
+
+	messageType             = 1
+	messageSocketFamily     = 2
+	messageSocketProtocol   = 3
+	messageQueryAddress     = 4
+	messageResponseAddress  = 5
+	messageQueryPort        = 6
+	messageResponsePort     = 7
+	messageQueryTimeSec     = 8
+	messageQueryTimeNsec    = 9
+	messageQueryMessage     = 10
+	messageResponseTimeSec  = 12
+	messageResponseTimeNsec = 13
+	messageResponseMessage  = 14
+	socketFamilyINET        = 1
+	socketFamilyINET6       = 2
+	protoVarint             = 0
+	protoFixed32            = 5
+	protoBytes              = 2
+)
+
+// marshal encodes m as a Dnstap protobuf message.
+func (m *DnstapMessage) marshal() []byte {
+	var msg []byte
+	msg = appendVarintField(msg, messageType, uint64(m.Type))
+	family := m.QueryAddress
+	if family == nil {
+		family = m.ResponseAddress
+	}
+	if family != nil {
+		if family.To4() != nil {
+			msg = appendVarintField(msg, messageSocketFamily, socketFamilyINET)
+		} else {
+			msg = appendVarintField(msg, messageSocketFamily, socketFamilyINET6)
+		}
+	}
+	if proto, ok := dnstapProtocols[m.Protocol]; ok {
+		msg = appendVarintField(msg, messageSocketProtocol, proto)
+	}
+	if m.QueryAddress != nil {
+		msg = appendBytesField(msg, messageQueryAddress, packIP(m.QueryAddress))
+		msg = appendVarintField(msg, messageQueryPort, uint64(m.QueryPort))
+	}
+	if m.ResponseAddress != nil {
+		msg = appendBytesField(msg, messageResponseAddress, packIP(m.ResponseAddress))
+		msg = appendVarintField(msg, messageResponsePort, uint64(m.ResponsePort))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, messageQueryTimeSec, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, messageQueryTimeNsec, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.QueryMessage != nil {
+		msg = appendBytesField(msg, messageQueryMessage, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, messageResponseTimeSec, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, messageResponseTimeNsec, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.ResponseMessage != nil {
+		msg = appendBytesField(msg, messageResponseMessage, m.ResponseMessage)
+	}
+
+	var b []byte
+	if len(m.Identity) > 0 {
+		b = appendBytesField(b, dnstapIdentity, m.Identity)
+	}
+	if len(m.Version) > 0 {
+		b = appendBytesField(b, dnstapVersion, m.Version)
+	}
+	b = appendBytesField(b, dnstapMessage, msg)
+	return appendVarintField(b, dnstapType, dnstapTypeMessage)
+}
+
+func packIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoFixed32)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// protoField is a field of a protobuf message, v holds varints and fixed32,
+// data the bytes fields.
+type protoField struct {
+	num  int
+	v    uint64
+	data []byte
+}
+
+// parseProto splits a protobuf message in its fields.
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case protoVarint:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return nil, errors.New("truncated protobuf fixed32")
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errors.New("truncated protobuf bytes")
+			}
+			f.data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// unmarshalDnstap decodes a Dnstap protobuf message.
+func unmarshalDnstap(b []byte) (*DnstapMessage, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+	m := &DnstapMessage{}
+	var msg []byte
+	for _, f := range fields {
+		switch f.num {
+		case dnstapIdentity:
+			m.Identity = f.data
+		case dnstapVersion:
+			m.Version = f.data
+		case dnstapMessage:
+			msg = f.data
+		}
+	}
+	if msg == nil {
+		return nil, errors.New("dnstap frame without message")
+	}
+	if fields, err = parseProto(msg); err != nil {
+		return nil, err
+	}
+	var querySec, queryNsec, respSec, respNsec uint64
+	for _, f := range fields {
+		switch f.num {
+		case messageType:
+			m.Type = DnstapType(f.v)
+		case messageSocketProtocol:
+			for name, proto := range dnstapProtocols {
+				if proto == f.v {
+					m.Protocol = name
+				}
+			}
+		case messageQueryAddress:
+			m.QueryAddress = net.IP(f.data)
+		case messageResponseAddress:
+			m.ResponseAddress = net.IP(f.data)
+		case messageQueryPort:
+			m.QueryPort = uint32(f.v)
+		case messageResponsePort:
+			m.ResponsePort = uint32(f.v)
+		case messageQueryTimeSec:
+			querySec = f.v
+		case messageQueryTimeNsec:
+			queryNsec = f.v
+		case messageResponseTimeSec:
+			respSec = f.v
+		case messageResponseTimeNsec:
+			respNsec = f.v
+		case messageQueryMessage:
+			m.QueryMessage = f.data
+		case messageResponseMessage:
+			m.ResponseMessage = f.data
+		}
+	}
+	if querySec != 0 {
+		m.QueryTime = time.Unix(int64(querySec), int64(queryNsec))
+	}
+	if respSec != 0 {
+		m.ResponseTime = time.Unix(int64(respSec), int64(respNsec))
+	}
+	return m, nil
+}
+
+// addrIPPort returns the ip and port of a tcp or udp address, nil if it has
+// none.
+func addrIPPort(addr net.Addr) (net.IP, uint32) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint32(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint32(a.Port)
+	}
+	return nil, 0
+}
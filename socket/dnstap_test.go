@@ -0,0 +1,281 @@
+package socket_test
+
+import (
+	"bytes"
+	"context"
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// readDnstap reads every message of a frame stream.
+func readDnstap(r io.Reader) ([]*socket.DnstapMessage, error) {
+	reader, err := socket.NewDnstapReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*socket.DnstapMessage
+	for {
+		m, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	u := startUpstream(t, nil)
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Dnstap: path, DnstapWire: true})
+
+	exchange(t, s.Addr().String(), newQuery(t, 42, "a.example.", dnsmessage.TypeA))
+	shutdown(s)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msgs, err := readDnstap(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []socket.DnstapType{
+		socket.DnstapClientQuery, socket.DnstapForwarderQuery,
+		socket.DnstapForwarderResponse, socket.DnstapClientResponse,
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("expected %d messages, got %d", len(want), len(msgs))
+	}
+	hostname, _ := os.Hostname()
+	_, upstreamPort, _ := net.SplitHostPort(u.addr)
+	for i, m := range msgs {
+		if m.Type != want[i] {
+			t.Errorf("message %d is %v, expected %v", i, m.Type, want[i])
+		}
+		if string(m.Identity) != hostname || m.Protocol != "udp" || m.QueryTime.IsZero() {
+			t.Errorf("bad %v message: %+v", m.Type, m)
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(m.QueryMessage); err != nil || query.Questions[0].Name.String() != "a.example." {
+			t.Errorf("%v: bad query message: %v", m.Type, err)
+		}
+		isResponse := m.Type == socket.DnstapClientResponse || m.Type == socket.DnstapForwarderResponse
+		if isResponse != (m.ResponseMessage != nil) || isResponse == m.ResponseTime.IsZero() {
+			t.Errorf("%v: unexpected response fields: %+v", m.Type, m)
+		}
+	}
+	client, forwarder := msgs[0], msgs[1]
+	if !client.QueryAddress.IsLoopback() || client.QueryPort == 0 {
+		t.Errorf("client query should have the client address: %+v", client)
+	}
+	if !forwarder.ResponseAddress.IsLoopback() || strconv.Itoa(int(forwarder.ResponsePort)) != upstreamPort {
+		t.Errorf("forwarder query should have the upstream address: %+v", forwarder)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(msgs[3].ResponseMessage); err != nil || resp.ID != 42 || len(resp.Answers) != 1 {
+		t.Errorf("bad client response: %+v, %v", resp, err)
+	}
+	// the forwarder messages have the id sent upstream
+	var fq, fr dnsmessage.Message
+	if err := fq.Unpack(msgs[1].QueryMessage); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.Unpack(msgs[2].ResponseMessage); err != nil {
+		t.Fatal(err)
+	}
+	if fq.ID != fr.ID {
+		t.Errorf("forwarder query id %d should be the forwarder response one %d", fq.ID, fr.ID)
+	}
+}
+
+// controlFrame returns an escaped frame streams control frame.
+func controlFrame(typ uint32, contentType string) []byte {
+	body := binary.BigEndian.AppendUint32(nil, typ)
+	if contentType != "" {
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(contentType)))
+		body = append(body, contentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(body)))
+	return append(frame, body...)
+}
+
+func TestDnstapUnixSocket(t *testing.T) {
+	// unix socket paths are short, unlike the temp dirs of tests
+	dir, err := os.MkdirTemp("", "tap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "dnstap.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	collected := make(chan []*socket.DnstapMessage, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(collected)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		ready := controlFrame(4, "protobuf:dnstap.Dnstap")
+		buf := make([]byte, len(ready))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(ready) {
+			t.Errorf("bad READY frame %x: %v", buf, err)
+		}
+		conn.Write(controlFrame(1, "protobuf:dnstap.Dnstap"))
+		msgs, err := readDnstap(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		collected <- msgs
+		conn.Write(controlFrame(5, ""))
+	}()
+
+	tap, err := socket.OpenDnstap("unix:"+l.Addr().String(), socket.DnstapOptions{Identity: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := startUpstream(t, nil)
+	s, err := socket.New(socket.Options{Upstreams: []string{u.addr}, Dnstap: tap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(context.Background(), pc)
+	exchange(t, pc.LocalAddr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	// the cached response is not forwarded
+	exchange(t, pc.LocalAddr().String(), newQuery(t, 2, "a.example.", dnsmessage.TypeA))
+	// the messages are all sent once the queries are done
+	shutdown(s)
+	if err := tap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := <-collected
+	if len(msgs) != 6 {
+		t.Fatalf("expected 6 messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if string(m.Identity) != "test" || m.QueryMessage != nil || m.ResponseMessage != nil {
+			t.Errorf("the wire messages should be omitted: %+v", m)
+		}
+	}
+	if msgs[5].Type != socket.DnstapClientResponse || msgs[4].Type != socket.DnstapClientQuery {
+		t.Errorf("the second query should only have client messages, got %v and %v", msgs[4].Type, msgs[5].Type)
+	}
+}
+
+// failingWriter fails the writes after the first n ones, keeping what they
+// wrote.
+type failingWriter struct {
+	n       int
+	written bytes.Buffer
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return w.written.Write(b)
+}
+
+func TestDnstapWriteError(t *testing.T) {
+	logger := &recordLogger{}
+	// the start frame is written, the messages aren't
+	tap, err := socket.NewDnstap(&failingWriter{n: 1}, socket.DnstapOptions{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tap.Log(&socket.DnstapMessage{Type: socket.DnstapClientQuery})
+	}
+	if err := tap.Close(); err == nil || err.Error() != "disk full" {
+		t.Errorf("close should return the write error, got %v", err)
+	}
+	if n := tap.Dropped(); n != 3 {
+		t.Errorf("dropped %d messages, want 3", n)
+	}
+	if !logger.contains("dnstap: disk full") {
+		t.Errorf("the write error should be logged: %q", logger.lines)
+	}
+}
+
+func TestDnstapDroppedCount(t *testing.T) {
+	// the buffer is flushed twice before the writes fail, the messages
+	// written and the ones dropped add up to the ones logged
+	w := &failingWriter{n: 3}
+	tap, err := socket.NewDnstap(w, socket.DnstapOptions{Wire: true, Logger: &recordLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const logged = 100
+	for i := 0; i < logged; i++ {
+		tap.Log(&socket.DnstapMessage{Type: socket.DnstapClientQuery, QueryMessage: make([]byte, 500)})
+	}
+	if err := tap.Close(); err == nil {
+		t.Fatal("close should return the write error")
+	}
+	msgs, err := readDnstap(&w.written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 0 || uint64(len(msgs))+tap.Dropped() != logged {
+		t.Errorf("%d messages written and %d dropped, out of %d", len(msgs), tap.Dropped(), logged)
+	}
+}
+
+func TestDnstapSkipsProbes(t *testing.T) {
+	u := startUpstream(t, nil)
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Dnstap: path, HealthInterval: 10 * time.Millisecond})
+
+	for deadline := time.Now().Add(5 * time.Second); u.queries.Load() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("the upstream was never probed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "dns_upstream_requests_total{") {
+		t.Errorf("the probes should not be counted:\n%s", rec.Body.String())
+	}
+	shutdown(s)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if msgs, err := readDnstap(f); err != nil || len(msgs) != 0 {
+		t.Errorf("the probes should not be logged: %d messages, %v", len(msgs), err)
+	}
+}
@@ -0,0 +1,131 @@
+package socket
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dohPath is where dns over https queries are served (RFC 8484)
+	dohPath = "/dns-query"
+	// dnsMessageType is the media type of dns over https messages
+	dnsMessageType = "application/dns-message"
+	// httpTimeout bounds reading a request and writing its response
+	httpTimeout = 10 * time.Second
+)
+
+// newHTTPServer returns the server answering dns over https queries, it
+// speaks http/2 when served over tls. More handlers can be added with
+// HandleHTTP, the metrics are only served on their own address.
+func (s *Socket) newHTTPServer() *http.Server {
+	s.httpMux = http.NewServeMux()
+	s.httpMux.HandleFunc(dohPath, s.dohHandler)
+	return &http.Server{
+		Handler:      s.httpMux,
+		ReadTimeout:  httpTimeout,
+		WriteTimeout: httpTimeout,
+		ErrorLog:     stdLogger(s.log),
+	}
+}
+
+// serveHTTP serves http requests on l until it's closed, over tls if a
+// certificate was given.
+func (s *Socket) serveHTTP(srv *http.Server, l net.Listener) {
+	var err error
+	if s.certFile != "" {
+		err = srv.ServeTLS(l, s.certFile, s.keyFile)
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.log.Println(err)
+	}
+}
+
+func (s *Socket) dohHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		query []byte
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		if err != nil || len(query) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dnsMessageType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(r.Body, maxUDPSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(query) == 0 || len(query) > maxUDPSize {
+			http.Error(w, "invalid dns message size", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	resp, ok := s.resolve(addr, query, "https")
+	if !ok {
+		http.Error(w, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	if _, err := w.Write(resp); err != nil {
+		s.log.Println(err)
+	}
+}
+
+// HandleHTTP registers handler for pattern on the http listener, next to the
+// dns over https endpoint.
+func (s *Socket) HandleHTTP(pattern string, handler http.Handler) error {
+	if s.httpMux == nil {
+		return fmt.Errorf("no http listener to serve %s on", pattern)
+	}
+	s.httpMux.Handle(pattern, handler)
+	return nil
+}
+
+// minTTL returns the smallest ttl of the records of a response, zero if it
+// has none.
+func minTTL(resp []byte) uint32 {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return 0
+	}
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, rs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range rs {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+				found = true
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,142 @@
+package socket_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoH(t *testing.T) {
+	u := startUpstream(t, nil)
+	certFile, keyFile, pool := selfSignedCert(t)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:  u.addr,
+		DoHAddr:  "127.0.0.1:0",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	url := "https://" + s.HTTPAddr().String() + "/dns-query"
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	query := newQuery(t, 0, "a.example.", dnsmessage.TypeA)
+	get, err := http.NewRequest(http.MethodGet, url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Fatalf("%s: bad response: %s %s", req.Method, resp.Proto, resp.Status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/dns-message" {
+			t.Errorf("%s: bad content type: %s", req.Method, ct)
+		}
+		// the second one may come from the cache a second later
+		if cc := resp.Header.Get("Cache-Control"); cc != "max-age=300" && cc != "max-age=299" {
+			t.Errorf("%s: bad cache control: %s", req.Method, cc)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Answers) != 1 {
+			t.Errorf("%s: bad answer: %+v", req.Method, msg)
+		}
+	}
+
+	for _, bad := range []struct {
+		method, query, contentType string
+		status                     int
+	}{
+		{http.MethodGet, "?dns=!!!", "", http.StatusBadRequest},
+		{http.MethodGet, "?dns=AAAA", "", http.StatusBadRequest},
+		{http.MethodPost, "", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "", "", http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(bad.method, url+bad.query, bytes.NewReader(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", bad.contentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != bad.status {
+			t.Errorf("%s %s: got %s, want %d", bad.method, bad.query, resp.Status, bad.status)
+		}
+	}
+
+	// the metrics are only served on their own address
+	resp, err := client.Get("https://" + s.HTTPAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics: got %s, want 404", resp.Status)
+	}
+}
+
+func TestDoHListenerReleased(t *testing.T) {
+	// the metrics listener fails on an address in use
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dohAddr := l.Addr().String()
+	l.Close()
+
+	_, err = socket.NewSocket(args.SocketArgs{
+		Addr:        "127.0.0.1:0",
+		Network:     "udp",
+		DNSAddr:     "127.0.0.1:53",
+		CacheSize:   128,
+		Workers:     1,
+		DoHAddr:     dohAddr,
+		MetricsAddr: busy.Addr().String(),
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	l, err = net.Listen("tcp", dohAddr)
+	if err != nil {
+		t.Fatalf("doh listener should be closed: %v", err)
+	}
+	l.Close()
+}
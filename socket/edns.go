@@ -0,0 +1,108 @@
+package socket
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// minUDPSize is the size every client accepts over udp (RFC 1035)
+	minUDPSize = 512
+	// defaultEDNSSize is the default largest udp response, it avoids ip
+	// fragmentation on most paths (DNS flag day 2020)
+	defaultEDNSSize = 1232
+	// rcodeBadVersion is the extended rcode answering unsupported EDNS
+	// versions (RFC 6891)
+	rcodeBadVersion dnsmessage.RCode = 16
+)
+
+// clientEDNS is what a query tells about the responses its client accepts.
+type clientEDNS struct {
+	// opt is the OPT record of the query, nil without EDNS0
+	opt *dnsmessage.Resource
+	// size is the largest response the client accepts
+	size     int
+	dnssecOK bool
+	version  uint8
+}
+
+// newClientEDNS reads the OPT record of a query. Udp responses are limited to
+// what the client advertises, within 512 and maxSize.
+func newClientEDNS(opt *dnsmessage.Resource, tcp bool, maxSize int) clientEDNS {
+	e := clientEDNS{opt: opt, size: minUDPSize}
+	if opt != nil {
+		e.dnssecOK = opt.Header.DNSSECAllowed()
+		e.version = uint8(opt.Header.TTL >> 16)
+		if size := int(opt.Header.Class); size > e.size {
+			e.size = size
+		}
+		if e.size > maxSize {
+			e.size = maxSize
+		}
+		if e.size < minUDPSize {
+			e.size = minUDPSize
+		}
+	}
+	if tcp {
+		e.size = maxUDPSize
+	}
+	return e
+}
+
+// splitOPT separates the OPT record from the other additional records.
+func splitOPT(additionals []dnsmessage.Resource) ([]dnsmessage.Resource, *dnsmessage.Resource) {
+	var opt *dnsmessage.Resource
+	rs := make([]dnsmessage.Resource, 0, len(additionals))
+	for i := range additionals {
+		if additionals[i].Header.Type == dnsmessage.TypeOPT {
+			opt = &additionals[i]
+			continue
+		}
+		rs = append(rs, additionals[i])
+	}
+	return rs, opt
+}
+
+// ednsReply returns the OPT record to answer an EDNS0 query with. The options
+// and extended rcode of the upstream OPT record are kept if there was one,
+// the payload size is ours and the DO bit the client's.
+func ednsReply(upstream *dnsmessage.Resource, rcode dnsmessage.RCode, size int, dnssecOK bool) dnsmessage.Resource {
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	if upstream != nil {
+		opt.Body = upstream.Body
+		rcode = upstream.Header.ExtendedRCode(rcode)
+	}
+	// SetEDNS0 never fails
+	_ = opt.Header.SetEDNS0(size, rcode, dnssecOK)
+	return opt
+}
+
+// setRCode sets the rcode of a response, the upper bits of an extended rcode
+// go in its OPT record, which must be added afterwards.
+func setRCode(msg *dnsmessage.Message, rcode dnsmessage.RCode) {
+	msg.RCode = rcode & 0xF
+}
+
+// packFitting packs msg within size bytes. Additional records are dropped
+// first, then if it's still too large the answer and authority sections too
+// and the TC bit is set so the client retries over tcp (RFC 2181 section 9).
+// The OPT record is always kept.
+func packFitting(msg *dnsmessage.Message, size int) ([]byte, error) {
+	b, err := msg.Pack()
+	if err != nil || len(b) <= size {
+		return b, err
+	}
+
+	_, opt := splitOPT(msg.Additionals)
+	msg.Additionals = nil
+	if opt != nil {
+		msg.Additionals = []dnsmessage.Resource{*opt}
+	}
+	if b, err = msg.Pack(); err != nil || len(b) <= size {
+		return b, err
+	}
+
+	msg.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	return msg.Pack()
+}
@@ -0,0 +1,68 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTruncation(t *testing.T) {
+	// about 1000 bytes, too big for plain udp
+	u := startUpstream(t, answerMany(60))
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, TCP: true})
+
+	for _, cached := range []bool{false, true} {
+		resp := exchange(t, s.Addr().String(), newQuery(t, 1, "big.example.", dnsmessage.TypeA))
+		if !resp.Truncated || len(resp.Answers) != 0 {
+			t.Errorf("cached %v: response should be truncated: %+v", cached, resp.Header)
+		}
+
+		resp = exchange(t, s.Addr().String(), newEDNSQuery(t, 2, "big.example.", dnsmessage.TypeA, 4096, 0))
+		if resp.Truncated || len(resp.Answers) != 60 {
+			t.Errorf("cached %v: response should fit the EDNS0 buffer: %+v", cached, resp.Header)
+		}
+		if len(resp.Additionals) != 1 || resp.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+			t.Errorf("cached %v: OPT record missing: %+v", cached, resp.Additionals)
+		}
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeMsg(conn, newQuery(t, 3, "big.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readMsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answers) != 60 {
+		t.Errorf("tcp response should be complete: %+v", resp.Header)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	resp := exchange(t, s.Addr().String(), newEDNSQuery(t, 1, "a.example.", dnsmessage.TypeA, 1232, 1))
+	if len(resp.Additionals) != 1 {
+		t.Fatalf("OPT record missing: %+v", resp)
+	}
+	if rcode := resp.Additionals[0].Header.ExtendedRCode(resp.RCode); rcode != 16 {
+		t.Errorf("expected BADVERS, got %v", rcode)
+	}
+	if u.queries.Load() != 0 {
+		t.Errorf("query should not have been forwarded")
+	}
+}
@@ -0,0 +1,76 @@
+package socket
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testOPT(t *testing.T, size int, dnssecOK bool) *dnsmessage.Resource {
+	opt := &dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	if err := opt.Header.SetEDNS0(size, dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		t.Fatal(err)
+	}
+	return opt
+}
+
+func TestClientEDNS(t *testing.T) {
+	tests := []struct {
+		opt  *dnsmessage.Resource
+		tcp  bool
+		size int
+	}{
+		{nil, false, 512},
+		{nil, true, 65535},
+		{testOPT(t, 4096, false), false, 1232},
+		{testOPT(t, 1000, false), false, 1000},
+		{testOPT(t, 100, false), false, 512},
+		{testOPT(t, 1000, false), true, 65535},
+	}
+	for i, tt := range tests {
+		if e := newClientEDNS(tt.opt, tt.tcp, 1232); e.size != tt.size {
+			t.Errorf("%d: bad size: %d != %d", i, e.size, tt.size)
+		}
+	}
+
+	if e := newClientEDNS(testOPT(t, 4096, true), false, 1232); !e.dnssecOK || e.version != 0 {
+		t.Errorf("bad flags: %+v", e)
+	}
+}
+
+func TestPackFitting(t *testing.T) {
+	msg := testMsg(dnsmessage.RCodeSuccess, testAnswers(make([]uint32, 20)...), nil)
+	msg.Additionals = append(testAnswers(make([]uint32, 20)...), *testOPT(t, 1232, false))
+	full, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dropping the additional records is enough
+	fitting := *msg
+	b, err := packFitting(&fitting, len(full)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got dnsmessage.Message
+	if err := got.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.Truncated || len(got.Answers) != 20 || len(got.Additionals) != 1 || got.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Errorf("only the additional records should have been dropped: %+v", got)
+	}
+
+	fitting = *msg
+	if b, err = packFitting(&fitting, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > 100 || !got.Truncated || len(got.Answers) != 0 || len(got.Additionals) != 1 {
+		t.Errorf("response should have been truncated: %+v", got)
+	}
+	if len(msg.Answers) != 20 || len(msg.Additionals) != 21 {
+		t.Errorf("original message should not be modified")
+	}
+}
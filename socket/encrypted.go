@@ -0,0 +1,301 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dotPort is the default port of dns over tls upstreams
+	dotPort = "853"
+	// dohIdleTimeout is how long an idle connection to a dns over https
+	// upstream is kept open
+	dohIdleTimeout = 90 * time.Second
+)
+
+// newEncryptedUpstream returns an upstream speaking dns over tls, for
+// tls://host[:port] urls, or dns over https, for https:// urls. Its
+// connections are kept open for the next queries.
+//
+// Two options can be given in the url query: sni=name sets the server name
+// sent and verified, it defaults to the url host. pin=base64 is the sha256 of
+// the public key (SPKI) the upstream certificate, or one of the certificates
+// it's issued by, must have. It can be repeated and replaces the verification
+// of the certificate chain up to the system roots, so self signed certificates
+// can be used.
+func newEncryptedUpstream(raw string, weight int, timeout time.Duration, conns int, logger Logger) (*Upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", raw, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %q: no host", raw)
+	}
+	sni, pins, rest, err := splitTLSOptions(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", raw, err)
+	}
+	u.RawQuery = rest
+	if sni == "" {
+		sni = u.Hostname()
+	}
+	config := tlsClientConfig(sni, pins, conns)
+
+	up := &Upstream{
+		addr:    u.String(),
+		network: u.Scheme,
+		weight:  weight,
+		log:     logger,
+	}
+	up.healthy.Store(true)
+	switch u.Scheme {
+	case "tls":
+		if (u.Path != "" && u.Path != "/") || rest != "" {
+			return nil, fmt.Errorf("invalid upstream %q: unexpected path or parameters", raw)
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), dotPort)
+		}
+		up.addr = "tls://" + addr
+		config.NextProtos = []string{"dot"}
+		pool := newConnPool("tls", addr, conns, timeout, logger)
+		pool.dial = func() (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+		}
+		up.udp, up.tcp = pool, pool
+	case "https":
+		client := newDoHClient(up.addr, config, conns, timeout)
+		up.udp, up.tcp = client, client
+	default:
+		return nil, fmt.Errorf("invalid upstream %q: unsupported scheme", raw)
+	}
+	return up, nil
+}
+
+// splitTLSOptions takes the sni and pin options out of a raw url query, the
+// other parameters are returned as they were.
+func splitTLSOptions(rawQuery string) (sni string, pins [][]byte, rest string, err error) {
+	var others []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "sni":
+			if sni, err = url.PathUnescape(value); err != nil {
+				return "", nil, "", err
+			}
+		case "pin":
+			pin, err := decodePin(value)
+			if err != nil {
+				return "", nil, "", err
+			}
+			pins = append(pins, pin)
+		default:
+			others = append(others, param)
+		}
+	}
+	return sni, pins, strings.Join(others, "&"), nil
+}
+
+// decodePin decodes a base64 sha256 digest, with the standard or url
+// alphabet, with or without padding.
+func decodePin(s string) ([]byte, error) {
+	s, err := url.PathUnescape(s)
+	if err != nil {
+		return nil, err
+	}
+	s = strings.TrimRight(strings.TrimPrefix(s, "sha256/"), "=")
+	pin, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		pin, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q", s)
+	}
+	return pin, nil
+}
+
+// tlsClientConfig returns the configuration of the connections to an
+// encrypted upstream, sessions are resumed when the connections are reopened.
+func tlsClientConfig(sni string, pins [][]byte, conns int) *tls.Config {
+	config := &tls.Config{
+		ServerName:         sni,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(conns),
+	}
+	if len(pins) == 0 {
+		return config
+	}
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		for i, cert := range certs {
+			if !matchesPin(cert, pins) {
+				continue
+			}
+			if i == 0 {
+				return nil
+			}
+			// the handshake only proves the server holds the key of the
+			// leaf, which must then be issued by the pinned certificate
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+			intermediates := x509.NewCertPool()
+			for _, c := range certs[1:i] {
+				intermediates.AddCert(c)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       sni,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err == nil {
+				return nil
+			}
+			return fmt.Errorf("certificate of %s is not issued by its pinned one: %w", sni, err)
+		}
+		return fmt.Errorf("no certificate of %s matches its pins", sni)
+	}
+	return config
+}
+
+// matchesPin reports whether the public key of cert is one of pins.
+func matchesPin(cert *x509.Certificate, pins [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// dohClient sends queries to a dns over https upstream (RFC 8484), over
+// connections kept open by its http transport.
+type dohClient struct {
+	url    string
+	client *http.Client
+
+	open     atomic.Int64
+	inFlight atomic.Int64
+	dials    atomic.Uint64
+	reuses   atomic.Uint64
+	errors   atomic.Uint64
+}
+
+func newDoHClient(url string, config *tls.Config, conns int, timeout time.Duration) *dohClient {
+	c := &dohClient{url: url}
+	dialer := &net.Dialer{Timeout: timeout}
+	c.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				c.dials.Add(1)
+				c.open.Add(1)
+				return &countedConn{Conn: conn, open: &c.open}, nil
+			},
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: timeout,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: conns,
+			IdleConnTimeout:     dohIdleTimeout,
+		},
+	}
+	return c
+}
+
+// exchange posts q to the upstream. The query id is zero, as RFC 8484
+// recommends, the response is matched by the http exchange.
+func (c *dohClient) exchange(q *upstreamQuery) ([]byte, error) {
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	q.setID(0)
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(q.msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.reuses.Add(1)
+			}
+		},
+	}))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.errors.Add(1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange with %s: %s", c.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, fmt.Errorf("exchange with %s: unexpected content type %q", c.url, ct)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxUDPSize+1))
+	if err != nil {
+		c.errors.Add(1)
+		return nil, fmt.Errorf("exchange with %s: %w", c.url, err)
+	}
+	if len(msg) > maxUDPSize {
+		return nil, fmt.Errorf("exchange with %s: response too long", c.url)
+	}
+	if err := q.check(msg); err != nil {
+		return nil, fmt.Errorf("exchange with %s: %w", c.url, err)
+	}
+	return msg, nil
+}
+
+func (c *dohClient) close() {
+	c.client.CloseIdleConnections()
+}
+
+func (c *dohClient) stats() PoolStats {
+	return PoolStats{
+		Upstream: c.url,
+		Network:  "https",
+		Open:     int(c.open.Load()),
+		InFlight: int(c.inFlight.Load()),
+		Dials:    c.dials.Load(),
+		Reuses:   c.reuses.Load(),
+		Errors:   c.errors.Load(),
+	}
+}
+
+// countedConn keeps the number of open connections of a dohClient.
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,164 @@
+package socket_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dns-resolver/args"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// certPin returns the pin of the certificate in certFile, the base64 sha256 of
+// its public key.
+func certPin(t *testing.T, certFile string) string {
+	t.Helper()
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	u := startUpstream(t, nil)
+	certFile, keyFile, _ := selfSignedCert(t)
+	// the encrypted upstream is another server forwarding to u
+	up := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:        u.addr,
+		DoTAddr:        "127.0.0.1:0",
+		DoHAddr:        "127.0.0.1:0",
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TCPIdleTimeout: 200 * time.Millisecond,
+	})
+	pin := certPin(t, certFile)
+
+	for _, upstream := range []string{
+		"tls://" + up.TLSAddr().String() + "?pin=" + pin,
+		"https://" + up.HTTPAddr().String() + "/dns-query?pin=" + pin,
+	} {
+		s := newUDPSocket(t, args.SocketArgs{DNSAddr: upstream})
+		for i, name := range []string{"a.example.", "b.example."} {
+			if i > 0 {
+				// the upstream closes the idle connection meanwhile
+				time.Sleep(400 * time.Millisecond)
+			}
+			resp := exchange(t, s.Addr().String(), newQuery(t, uint16(i), name, dnsmessage.TypeA))
+			if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || resp.ID != uint16(i) {
+				t.Fatalf("%s: bad response for %s: %+v", upstream, name, resp)
+			}
+		}
+		if st := s.PoolStats(); len(st) != 1 || st[0].Dials == 0 {
+			t.Errorf("%s: bad pool stats: %+v", upstream, st)
+		}
+	}
+
+	// a certificate not matching the pin is refused
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: "tls://" + up.TLSAddr().String() + "?pin=" + wrongPin})
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "c.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("pinning should have failed, got %v", resp.RCode)
+	}
+}
+
+// issueCert returns a certificate for 127.0.0.1 and its key, signed by parent
+// and parentKey, or self signed if parent is nil.
+func issueCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "dns-resolver test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeChain writes the pem files of a certificate chain and of the key of
+// its leaf.
+func writeChain(t *testing.T, key *ecdsa.PrivateKey, chain ...*x509.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	var certPEM []byte
+	for _, cert := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestPinnedIssuer(t *testing.T) {
+	u := startUpstream(t, nil)
+	ca, caKey := issueCert(t, nil, nil, true)
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	pin := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	issued, issuedKey := issueCert(t, ca, caKey, false)
+	// the pinned certificate is public, anyone can send it behind their leaf
+	forged, forgedKey := issueCert(t, nil, nil, false)
+	for _, tt := range []struct {
+		leaf  *x509.Certificate
+		key   *ecdsa.PrivateKey
+		rcode dnsmessage.RCode
+	}{
+		{issued, issuedKey, dnsmessage.RCodeSuccess},
+		{forged, forgedKey, dnsmessage.RCodeServerFailure},
+	} {
+		certFile, keyFile := writeChain(t, tt.key, tt.leaf, ca)
+		up := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, DoTAddr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile})
+		s := newUDPSocket(t, args.SocketArgs{DNSAddr: "tls://" + up.TLSAddr().String() + "?pin=" + pin})
+		resp := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+		if resp.RCode != tt.rcode {
+			t.Errorf("expected %v, got %v", tt.rcode, resp.RCode)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package socket
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// flightKey tells apart the queries that can share an upstream response.
+	// Besides the cache key, the transport decides whether the response may
+	// be truncated and the client EDNS what the upstream puts in it.
+	flightKey struct {
+		cacheKey
+		tcp  bool
+		edns bool
+	}
+
+	// flight is an upstream query in progress, the queries joining it wait
+	// for its result instead of sending their own.
+	flight struct {
+		wg       sync.WaitGroup
+		resp     []byte
+		upstream string
+		err      error
+	}
+
+	// flightGroup coalesces the identical queries missing the cache, so only
+	// one of them is forwarded at a time.
+	flightGroup struct {
+		mu      sync.Mutex
+		flights map[flightKey]*flight
+
+		forwarded    atomic.Uint64
+		deduplicated atomic.Uint64
+	}
+
+	// CoalesceStats counts the queries missing the cache.
+	CoalesceStats struct {
+		// Forwarded is the number of queries sent upstream
+		Forwarded uint64
+		// Deduplicated is the number of queries answered with the response
+		// of an identical query already in flight
+		Deduplicated uint64
+	}
+)
+
+// do calls forward, unless an identical query is already in flight, in which
+// case it waits for its result: the response and the upstream it came from.
+// shared reports whether the result came from another query, the response
+// must not be modified as others may use it.
+func (g *flightGroup) do(key flightKey, forward func() ([]byte, string, error)) (resp []byte, upstream string, err error, shared bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[flightKey]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		g.deduplicated.Add(1)
+		f.wg.Wait()
+		return f.resp, f.upstream, f.err, true
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	g.forwarded.Add(1)
+	f.resp, f.upstream, f.err = forward()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.wg.Done()
+	return f.resp, f.upstream, f.err, false
+}
+
+func (g *flightGroup) stats() CoalesceStats {
+	return CoalesceStats{
+		Forwarded:    g.forwarded.Load(),
+		Deduplicated: g.deduplicated.Load(),
+	}
+}
+
+// CoalesceStats returns how many queries were forwarded and deduplicated.
+func (s *Socket) CoalesceStats() CoalesceStats {
+	return s.flights.stats()
+}
+
+// withID returns a copy of msg with its id set to id.
+func withID(msg []byte, id uint16) []byte {
+	c := make([]byte, len(msg))
+	copy(c, msg)
+	binary.BigEndian.PutUint16(c, id)
+	return c
+}
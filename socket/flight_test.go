@@ -0,0 +1,39 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCoalescing(t *testing.T) {
+	answer := answerA([4]byte{1, 2, 3, 4}, 300)
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		time.Sleep(200 * time.Millisecond)
+		return answer(q)
+	})
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Workers: 16})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			resp := exchange(t, s.Addr().String(), newQuery(t, id, "popular.example.", dnsmessage.TypeA))
+			if resp.ID != id || len(resp.Answers) != 1 {
+				t.Errorf("bad response for query %d: %+v", id, resp)
+			}
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("upstream should have been asked once, got %d", n)
+	}
+	if st := s.CoalesceStats(); st.Forwarded != 1 || st.Deduplicated != 9 {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
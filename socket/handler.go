@@ -0,0 +1,177 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// headerLen is the size of the header starting every dns message
+const headerLen = 12
+
+type (
+	// Handler answers dns queries. The server hands it the queries having a
+	// question and a supported EDNS version, the others are answered before.
+	Handler interface {
+		// ServeDNS answers r through w, or drops it by writing nothing. r
+		// must not be used once it returns.
+		ServeDNS(ctx context.Context, w ResponseWriter, r *dnsmessage.Message)
+	}
+
+	// HandlerFunc is a function used as a Handler.
+	HandlerFunc func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message)
+
+	// ResponseWriter sends the response to a query back to its client.
+	ResponseWriter interface {
+		// WriteMsg packs m and sends it, truncated to what the client
+		// accepts.
+		WriteMsg(m *dnsmessage.Message) error
+		// Write sends a packed response, truncated like WriteMsg does.
+		Write(b []byte) (int, error)
+		// RemoteAddr returns the address of the client, nil for the queries
+		// of Resolve.
+		RemoteAddr() net.Addr
+		// Stream reports whether the client transport carries responses of
+		// any size, as opposed to udp.
+		Stream() bool
+	}
+
+	// dnsWriter is the ResponseWriter given to handlers, size is the largest
+	// response its client accepts. rcode is the one of the response written,
+	// if written is set.
+	dnsWriter struct {
+		t       responseWriter
+		addr    net.Addr
+		size    int
+		rcode   dnsmessage.RCode
+		written bool
+		// resp is the response written, for the query log and dnstap
+		resp []byte
+	}
+)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+	f(ctx, w, r)
+}
+
+func (w *dnsWriter) WriteMsg(m *dnsmessage.Message) error {
+	b, err := packFitting(m, w.size)
+	if err != nil {
+		return err
+	}
+	return w.write(b)
+}
+
+func (w *dnsWriter) Write(b []byte) (int, error) {
+	if len(b) > w.size {
+		// the upstream may allow bigger responses than our client
+		var m dnsmessage.Message
+		if err := m.Unpack(b); err != nil {
+			return 0, err
+		}
+		return len(b), w.WriteMsg(&m)
+	}
+	return len(b), w.write(b)
+}
+
+func (w *dnsWriter) write(b []byte) error {
+	if len(b) < headerLen {
+		return fmt.Errorf("response of %d bytes is shorter than a dns header", len(b))
+	}
+	if err := w.t.writeMsg(b); err != nil {
+		return err
+	}
+	// the extended bits are left out, the OPT record is not parsed again
+	w.rcode = dnsmessage.RCode(b[3] & 0x0f)
+	w.written = true
+	w.resp = b
+	return nil
+}
+
+func (w *dnsWriter) RemoteAddr() net.Addr { return w.addr }
+
+func (w *dnsWriter) Stream() bool { return w.t.stream() }
+
+// tapClient sends a client message to dnstap.
+func (s *Socket) tapClient(typ DnstapType, addr net.Addr, proto string, queryTime time.Time, query []byte, respTime time.Time, resp []byte) {
+	ip, port := addrIPPort(addr)
+	s.opts.Dnstap.Log(&DnstapMessage{
+		Type:            typ,
+		Protocol:        proto,
+		QueryAddress:    ip,
+		QueryPort:       port,
+		QueryTime:       queryTime,
+		QueryMessage:    query,
+		ResponseTime:    respTime,
+		ResponseMessage: resp,
+	})
+}
+
+// serveQuery parses a query and hands it to the handler, unless it has no
+// question, which is dropped, or asks for an unsupported EDNS version. The
+// queries handled are counted in the metrics, and logged by the query log
+// when they are sampled.
+func (s *Socket) serveQuery(req QueueRequest) {
+	start := time.Now()
+	var query dnsmessage.Message
+	if err := query.Unpack(req.Data[:req.Length]); err != nil {
+		s.log.Println(err)
+		return
+	}
+	if len(query.Questions) == 0 {
+		s.log.Println("query without question")
+		return
+	}
+	_, opt := splitOPT(query.Additionals)
+	edns := newClientEDNS(opt, req.w.stream(), s.opts.EDNSSize)
+	w := &dnsWriter{t: req.w, addr: req.Addr, size: edns.size}
+	proto := req.w.protocol()
+	if s.opts.Dnstap != nil {
+		s.tapClient(DnstapClientQuery, req.Addr, proto, start, req.Data[:req.Length], time.Time{}, nil)
+	}
+	ctx := s.ctx
+	var info *queryInfo
+	if s.opts.QueryLog != nil && s.opts.QueryLog.sampled() {
+		ctx, info = withQueryInfo(ctx)
+	}
+	if edns.opt != nil && edns.version > 0 {
+		s.WriteError(w, &query, rcodeBadVersion)
+	} else {
+		s.handler.ServeDNS(ctx, w, &query)
+	}
+
+	latency := time.Since(start)
+	if s.opts.Dnstap != nil && w.written {
+		s.tapClient(DnstapClientResponse, req.Addr, proto, start, req.Data[:req.Length], start.Add(latency), w.resp)
+	}
+	q := query.Questions[0]
+	rcode := "dropped"
+	if w.written {
+		rcode = rcodeName(w.rcode)
+	}
+	s.metrics.queries.inc(proto, typeName(q.Type), rcode)
+	s.metrics.queryDuration.observe(latency, proto)
+	if info == nil {
+		return
+	}
+	record := QueryRecord{
+		Time:     start,
+		Protocol: proto,
+		Name:     q.Name.String(),
+		Type:     typeName(q.Type),
+		RCode:    rcode,
+		CacheHit: info.cacheHit,
+		Upstream: info.upstream,
+		Latency:  float64(latency) / float64(time.Millisecond),
+		Size:     len(w.resp),
+	}
+	if req.Addr != nil {
+		record.Client = req.Addr.String()
+	}
+	if err := s.opts.QueryLog.Log(&record); err != nil {
+		s.log.Println(err)
+	}
+}
@@ -0,0 +1,122 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newUDPSocket(t *testing.T, a args.SocketArgs) *socket.Socket {
+	t.Helper()
+	a.Addr = "127.0.0.1:0"
+	a.Network = "udp"
+	if a.CacheSize == 0 {
+		a.CacheSize = 128
+	}
+	if a.Workers == 0 {
+		a.Workers = 2
+	}
+	s, err := socket.NewSocket(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ListenAndServe()
+	t.Cleanup(func() { shutdown(s) })
+	return s
+}
+
+// exchange sends a query to addr over udp and returns the parsed response.
+func exchange(t *testing.T, addr string, query []byte) dnsmessage.Message {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCachedResponse(t *testing.T) {
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		resp := answerA([4]byte{1, 2, 3, 4}, 300)(q)
+		resp.AuthenticData = true
+		resp.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 600},
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.example.")},
+		}}
+		resp.Additionals = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("ns.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 600},
+			Body:   &dnsmessage.AResource{A: [4]byte{5, 6, 7, 8}},
+		}}
+		return resp
+	})
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	fresh := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	cached := exchange(t, s.Addr().String(), newQuery(t, 2, "a.example.", dnsmessage.TypeA))
+	if n := u.queries.Load(); n != 1 {
+		t.Fatalf("second query should be answered from cache, upstream got %d queries", n)
+	}
+	if cached.ID != 2 {
+		t.Errorf("bad id: %d", cached.ID)
+	}
+
+	// ttls may have been decremented in between
+	for _, m := range []*dnsmessage.Message{&fresh, &cached} {
+		m.ID = 0
+		for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+			for i := range rs {
+				rs[i].Header.TTL = 0
+			}
+		}
+	}
+	if !reflect.DeepEqual(fresh, cached) {
+		t.Errorf("cached response differs from the fresh one:\n%+v\n%+v", fresh, cached)
+	}
+}
+
+func TestCacheCheckingDisabled(t *testing.T) {
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		// an upstream validator only answers bogus data when CD is set
+		if !q.CheckingDisabled {
+			resp := answerA([4]byte{}, 0)(q)
+			resp.RCode = dnsmessage.RCodeServerFailure
+			resp.Answers = nil
+			return resp
+		}
+		return answerA([4]byte{1, 2, 3, 4}, 300)(q)
+	})
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	cd := newQuery(t, 1, "bogus.example.", dnsmessage.TypeA)
+	cd[3] |= 0x10
+	if resp := exchange(t, s.Addr().String(), cd); len(resp.Answers) != 1 {
+		t.Fatalf("bad CD response: %+v", resp)
+	}
+	resp := exchange(t, s.Addr().String(), newQuery(t, 2, "bogus.example.", dnsmessage.TypeA))
+	if len(resp.Answers) != 0 || resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("response cached for a CD query answered without it: %+v", resp)
+	}
+	if n := u.queries.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2", n)
+	}
+}
@@ -0,0 +1,229 @@
+package socket_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream is a dns server listening on udp and tcp on the same port,
+// answering every query with handler.
+type fakeUpstream struct {
+	addr    string
+	queries atomic.Int32
+	// drop is the number of next queries left unanswered
+	drop    atomic.Int32
+	handler func(q dnsmessage.Message) dnsmessage.Message
+}
+
+func startUpstream(t testing.TB, handler func(q dnsmessage.Message) dnsmessage.Message) *fakeUpstream {
+	t.Helper()
+	if handler == nil {
+		handler = answerA([4]byte{1, 2, 3, 4}, 300)
+	}
+	u := &fakeUpstream{handler: handler}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	u.addr = pc.LocalAddr().String()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := u.respond(buf[:n]); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					msg, err := readMsg(conn)
+					if err != nil {
+						return
+					}
+					if resp := u.respond(msg); resp != nil {
+						writeMsg(conn, resp)
+					}
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) respond(in []byte) []byte {
+	u.queries.Add(1)
+	if u.drop.Add(-1) >= 0 {
+		return nil
+	}
+	var q dnsmessage.Message
+	if err := q.Unpack(in); err != nil {
+		return nil
+	}
+	resp := u.handler(q)
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// answerA returns a handler answering every question with an A record.
+func answerA(ip [4]byte, ttl uint32) func(q dnsmessage.Message) dnsmessage.Message {
+	return func(q dnsmessage.Message) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionDesired: q.RecursionDesired, RecursionAvailable: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: ip},
+			}},
+		}
+	}
+}
+
+func newQuery(t testing.TB, id uint16, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// newEDNSQuery returns a query with an OPT record advertising size.
+func newEDNSQuery(t testing.TB, id uint16, name string, typ dnsmessage.Type, size int, version uint8) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(newQuery(t, id, name, typ)); err != nil {
+		t.Fatal(err)
+	}
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	if err := opt.Header.SetEDNS0(size, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	opt.Header.TTL |= uint32(version) << 16
+	msg.Additionals = []dnsmessage.Resource{opt}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// answerMany returns a handler answering every question with n A records.
+func answerMany(n int) func(q dnsmessage.Message) dnsmessage.Message {
+	return func(q dnsmessage.Message) dnsmessage.Message {
+		resp := answerA([4]byte{10, 0, 0, 0}, 300)(q)
+		for i := 1; i < n; i++ {
+			a := resp.Answers[0]
+			a.Body = &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}}
+			resp.Answers = append(resp.Answers, a)
+		}
+		return resp
+	}
+}
+
+// selfSignedCert writes a certificate for 127.0.0.1 and its key in a temporary
+// directory, it returns their paths and a pool trusting the certificate.
+func selfSignedCert(t testing.TB) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns-resolver test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certFile, keyFile, pool
+}
@@ -0,0 +1,466 @@
+package socket
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// hostsTTL is the ttl of the records of hosts files
+	hostsTTL = 300
+	// maxCNAMEChain bounds the local CNAME records followed for a query
+	maxCNAMEChain = 8
+)
+
+type (
+	// Records is a set of local records, answered authoritatively. It's not
+	// modified once built.
+	//
+	// Hosts files give A and AAAA records, and a PTR record from each
+	// address to the first name it's given. Zone files are in the RFC 1035
+	// format, with A, AAAA, CNAME, MX, TXT, SRV, PTR, NS and SOA records:
+	// the names of a zone having a SOA record and no records get an
+	// NXDOMAIN, the other names missing from the records are not answered.
+	Records struct {
+		// names are the records by lower case owner name, the names with
+		// subdomains in a zone but no records have an empty entry
+		names map[string][]dnsmessage.Resource
+		// zones are the SOA records by lower case zone name
+		zones map[string]*dnsmessage.Resource
+		count int
+	}
+
+	// Authority is the plugin answering the queries for the names of its
+	// Records, which can be replaced while serving. An Authority made by
+	// LoadAuthority reloads its files on Reload.
+	Authority struct {
+		records atomic.Pointer[Records]
+
+		// reloadMu serializes the reloads of the files
+		reloadMu     sync.Mutex
+		hosts, zones []string
+	}
+
+	// localAnswer is what Records answers a question with. chase is the
+	// target of a CNAME record outside the records, which is left to the
+	// next plugins.
+	localAnswer struct {
+		rcode       dnsmessage.RCode
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		chase       *dnsmessage.Name
+	}
+
+	// captureWriter is a ResponseWriter keeping the response instead of
+	// writing it.
+	captureWriter struct {
+		ResponseWriter
+		msg []byte
+	}
+)
+
+// NewRecords returns the records read from hosts files and zone files.
+func NewRecords(hosts, zones []io.Reader) (*Records, error) {
+	r := newRecords()
+	for _, h := range hosts {
+		if err := r.parseHosts(h); err != nil {
+			return nil, err
+		}
+	}
+	for _, z := range zones {
+		if err := r.parseZone(z); err != nil {
+			return nil, err
+		}
+	}
+	r.addEmptyNames()
+	return r, nil
+}
+
+func newRecords() *Records {
+	return &Records{
+		names: make(map[string][]dnsmessage.Resource),
+		zones: make(map[string]*dnsmessage.Resource),
+	}
+}
+
+// LoadRecords returns the records read from the files of hosts and zones,
+// see NewRecords.
+func LoadRecords(hosts, zones []string) (*Records, error) {
+	r := newRecords()
+	for i, paths := range [][]string{hosts, zones} {
+		for _, path := range paths {
+			if err := r.load(path, i == 1); err != nil {
+				return nil, fmt.Errorf("load %s: %w", path, err)
+			}
+		}
+	}
+	r.addEmptyNames()
+	return r, nil
+}
+
+// load adds the records of a hosts file, or of a zone file if zone is true.
+func (r *Records) load(path string, zone bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if zone {
+		return r.parseZone(f)
+	}
+	return r.parseHosts(f)
+}
+
+// parseZone adds the records of a zone file, whose relative names need an
+// $ORIGIN.
+func (r *Records) parseZone(zone io.Reader) error {
+	records, err := parseZone(zone, "")
+	if err != nil {
+		return err
+	}
+	for _, rr := range records {
+		r.add(rr)
+	}
+	return nil
+}
+
+// parseHosts adds the records of a hosts file.
+func (r *Records) parseHosts(hosts io.Reader) error {
+	scanner := bufio.NewScanner(hosts)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		var first dnsmessage.Name
+		for _, host := range fields[1:] {
+			name, ok := normalizeDomain(host)
+			if !ok {
+				continue
+			}
+			owner, err := dnsmessage.NewName(name)
+			if err != nil {
+				continue
+			}
+			if first.Length == 0 {
+				first = owner
+			}
+			header := dnsmessage.ResourceHeader{Name: owner, Class: dnsmessage.ClassINET, TTL: hostsTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				body := &dnsmessage.AResource{}
+				copy(body.A[:], ip4)
+				header.Type = dnsmessage.TypeA
+				r.add(dnsmessage.Resource{Header: header, Body: body})
+			} else {
+				body := &dnsmessage.AAAAResource{}
+				copy(body.AAAA[:], ip)
+				header.Type = dnsmessage.TypeAAAA
+				r.add(dnsmessage.Resource{Header: header, Body: body})
+			}
+		}
+		if first.Length == 0 || ip.IsUnspecified() {
+			continue
+		}
+		// the first name given to an address is its canonical one
+		ptr, err := dnsmessage.NewName(reverseName(ip))
+		if err != nil {
+			continue
+		}
+		if _, ok := r.names[strings.ToLower(ptr.String())]; !ok {
+			r.add(dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: ptr, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: hostsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: first},
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	const hex = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// add adds a record, unless the same one is already there.
+func (r *Records) add(rr dnsmessage.Resource) {
+	name := strings.ToLower(rr.Header.Name.String())
+	for _, old := range r.names[name] {
+		if old.Header.Type == rr.Header.Type && old.Body.GoString() == rr.Body.GoString() {
+			return
+		}
+	}
+	r.names[name] = append(r.names[name], rr)
+	r.count++
+	if rr.Header.Type == dnsmessage.TypeSOA {
+		if _, ok := r.zones[name]; !ok {
+			r.zones[name] = &rr
+		}
+	}
+}
+
+// addEmptyNames adds the names having subdomains in a zone, so they are
+// answered with no records rather than NXDOMAIN.
+func (r *Records) addEmptyNames() {
+	for name := range r.names {
+		zone := r.zone(name)
+		if zone == "" {
+			continue
+		}
+		for parent := name; parent != zone; {
+			if _, parent, _ = strings.Cut(parent, "."); parent == "" {
+				parent = "."
+			}
+			if _, ok := r.names[parent]; !ok {
+				r.names[parent] = nil
+			}
+		}
+	}
+}
+
+// zone returns the closest zone a lower case name is in, empty if none.
+func (r *Records) zone(name string) string {
+	for suffix := name; ; {
+		if _, ok := r.zones[suffix]; ok {
+			return suffix
+		}
+		if suffix == "." {
+			return ""
+		}
+		if _, suffix, _ = strings.Cut(suffix, "."); suffix == "" {
+			suffix = "."
+		}
+	}
+}
+
+// Len returns the number of records and of zones.
+func (r *Records) Len() (records, zones int) {
+	return r.count, len(r.zones)
+}
+
+// Lookup returns the records of name and type typ, TypeALL for all of them,
+// following the CNAME records of name. It reports false if name is not in
+// the records.
+func (r *Records) Lookup(name string, typ dnsmessage.Type) ([]dnsmessage.Resource, bool) {
+	n, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, false
+	}
+	ans, ok := r.answer(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	return ans.answers, ok && ans.rcode == dnsmessage.RCodeSuccess
+}
+
+// answer returns the answer to q, false if its name is neither in the
+// records nor in one of their zones.
+func (r *Records) answer(q dnsmessage.Question) (localAnswer, bool) {
+	var ans localAnswer
+	owner := q.Name
+	for i := 0; ; i++ {
+		name := strings.ToLower(owner.String())
+		records, ok := r.names[name]
+		zone := r.zone(name)
+		if !ok {
+			switch {
+			case i == 0 && zone == "":
+				return ans, false
+			case zone == "":
+				ans.chase = &owner
+			default:
+				ans.rcode = dnsmessage.RCodeNameError
+				ans.authorities = r.soa(zone)
+			}
+			return ans, true
+		}
+
+		if q.Type != dnsmessage.TypeCNAME && q.Type != dnsmessage.TypeALL {
+			if cname := findType(records, dnsmessage.TypeCNAME); cname != nil && i < maxCNAMEChain {
+				rr := *cname
+				rr.Header.Name = owner
+				ans.answers = append(ans.answers, rr)
+				owner = cname.Body.(*dnsmessage.CNAMEResource).CNAME
+				continue
+			}
+		}
+
+		found := false
+		for _, rr := range records {
+			if rr.Header.Type == q.Type || q.Type == dnsmessage.TypeALL {
+				rr.Header.Name = owner
+				ans.answers = append(ans.answers, rr)
+				found = true
+			}
+		}
+		if !found && zone != "" {
+			// no data, the SOA tells how long that may be cached
+			ans.authorities = r.soa(zone)
+		}
+		return ans, true
+	}
+}
+
+func findType(records []dnsmessage.Resource, typ dnsmessage.Type) *dnsmessage.Resource {
+	for i := range records {
+		if records[i].Header.Type == typ {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// soa returns the SOA record of zone for the authority section of negative
+// answers, with the ttl they are cached for (RFC 2308 section 3).
+func (r *Records) soa(zone string) []dnsmessage.Resource {
+	rr := *r.zones[zone]
+	if minTTL := rr.Body.(*dnsmessage.SOAResource).MinTTL; minTTL < rr.Header.TTL {
+		rr.Header.TTL = minTTL
+	}
+	return []dnsmessage.Resource{rr}
+}
+
+// NewAuthority returns an Authority answering from records.
+func NewAuthority(records *Records) *Authority {
+	a := &Authority{}
+	a.records.Store(records)
+	return a
+}
+
+// LoadAuthority returns an Authority answering from the files of hosts and
+// zones, see LoadRecords. Reload reads them again.
+func LoadAuthority(hosts, zones []string) (*Authority, error) {
+	records, err := LoadRecords(hosts, zones)
+	if err != nil {
+		return nil, err
+	}
+	a := NewAuthority(records)
+	a.hosts, a.zones = hosts, zones
+	return a, nil
+}
+
+// Reload reads the files again into new records and swaps them with the ones
+// in use, which are kept if any file fails to load.
+func (a *Authority) Reload() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	if a.hosts == nil && a.zones == nil {
+		return nil
+	}
+	records, err := LoadRecords(a.hosts, a.zones)
+	if err != nil {
+		return err
+	}
+	a.records.Store(records)
+	return nil
+}
+
+// String describes the records in use.
+func (a *Authority) String() string {
+	records, zones := a.records.Load().Len()
+	return fmt.Sprintf("%d local records in %d zones", records, zones)
+}
+
+// Records returns the records in use.
+func (a *Authority) Records() *Records {
+	return a.records.Load()
+}
+
+// SetRecords replaces the records, the queries being answered keep the
+// previous ones.
+func (a *Authority) SetRecords(records *Records) {
+	a.records.Store(records)
+}
+
+// Plugin is the plugin answering the queries for the local names, the others
+// go to next. The targets of local CNAME records which are not local are
+// resolved by next, and added to the answer.
+func (a *Authority) Plugin(s *Socket, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+		q := r.Questions[0]
+		if q.Class != dnsmessage.ClassINET {
+			next.ServeDNS(ctx, w, r)
+			return
+		}
+		ans, ok := a.records.Load().answer(q)
+		if !ok {
+			next.ServeDNS(ctx, w, r)
+			return
+		}
+		authoritative := true
+		if ans.chase != nil {
+			resp, ok := chaseCNAME(ctx, next, w, r, *ans.chase)
+			if !ok {
+				s.WriteError(w, r, dnsmessage.RCodeServerFailure)
+				return
+			}
+			ans.rcode = resp.RCode
+			ans.answers = append(ans.answers, resp.Answers...)
+			ans.authorities = resp.Authorities
+			authoritative = false
+		}
+
+		_, opt := splitOPT(r.Additionals)
+		edns := newClientEDNS(opt, w.Stream(), s.opts.EDNSSize)
+		msg := errorResponse(r.Header, r.Questions, edns, ans.rcode, s.opts.EDNSSize)
+		msg.Authoritative = authoritative
+		msg.Answers = ans.answers
+		msg.Authorities = ans.authorities
+		if err := w.WriteMsg(&msg); err != nil {
+			s.log.Println(err)
+		}
+	})
+}
+
+// chaseCNAME asks next for target, with the type and options of r.
+func chaseCNAME(ctx context.Context, next Handler, w ResponseWriter, r *dnsmessage.Message, target dnsmessage.Name) (dnsmessage.Message, bool) {
+	query := *r
+	query.Questions = []dnsmessage.Question{{Name: target, Type: r.Questions[0].Type, Class: r.Questions[0].Class}}
+	capture := &captureWriter{ResponseWriter: w}
+	next.ServeDNS(ctx, capture, &query)
+	var resp dnsmessage.Message
+	if capture.msg == nil || resp.Unpack(capture.msg) != nil {
+		return resp, false
+	}
+	return resp, true
+}
+
+func (w *captureWriter) WriteMsg(m *dnsmessage.Message) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.msg = b
+	return nil
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.msg = b
+	return len(b), nil
+}
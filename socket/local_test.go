@@ -0,0 +1,237 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testZone = `$ORIGIN lan.
+$TTL 1h
+@	IN	SOA	ns.lan. admin.lan. (
+		2024010101 ; serial
+		1h 15m 1w
+		60 )	; minimum
+	IN	NS	ns
+ns		A	10.0.0.1
+www	300	IN	A	10.0.0.2
+	IN	AAAA	fd00::2
+alias		CNAME	www
+outside		CNAME	cdn.example.
+loop		CNAME	loop
+@		MX	10 mail
+mail		A	10.0.0.3
+info		TXT	"v=spf1 -all" "with \"quotes\"; and more"
+_sip._tcp	SRV	10 5 5060 www
+2.0.0.10.in-addr.arpa.	PTR	www
+`
+
+const testHosts = `# local hosts
+192.168.1.10	printer.lan printer   # the printer
+fd00::10	printer.lan
+192.168.1.11	nas.lan
+0.0.0.0	blocked.example
+fe80::1%eth0	linklocal.lan
+`
+
+// serveRecords serves the records of testZone and testHosts, forwarding the
+// other names to u.
+func serveRecords(t *testing.T, u *fakeUpstream) string {
+	t.Helper()
+	records, err := socket.NewRecords([]io.Reader{strings.NewReader(testHosts)}, []io.Reader{strings.NewReader(testZone)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		Plugins:   []socket.Plugin{socket.NewAuthority(records).Plugin, socket.Cache, socket.Forward},
+	})
+}
+
+func TestAuthority(t *testing.T) {
+	u := startUpstream(t, nil)
+	addr := serveRecords(t, u)
+
+	for _, tt := range []struct {
+		name          string
+		typ           dnsmessage.Type
+		rcode         dnsmessage.RCode
+		answers       []string
+		authoritative bool
+		soa           bool
+	}{
+		{"www.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"www.lan. 300 A 10.0.0.2"}, true, false},
+		{"WWW.Lan.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"WWW.Lan. 3600 AAAA fd00::2"}, true, false},
+		{"alias.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"alias.lan. 3600 CNAME www.lan.", "www.lan. 300 A 10.0.0.2"}, true, false},
+		{"alias.lan.", dnsmessage.TypeCNAME, dnsmessage.RCodeSuccess, []string{"alias.lan. 3600 CNAME www.lan."}, true, false},
+		{"outside.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"outside.lan. 3600 CNAME cdn.example.", "cdn.example. 300 A 1.2.3.4"}, false, false},
+		{"lan.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, []string{"lan. 3600 MX 10 mail.lan."}, true, false},
+		{"info.lan.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, []string{`info.lan. 3600 TXT ["v=spf1 -all" "with \"quotes\"; and more"]`}, true, false},
+		{"_sip._tcp.lan.", dnsmessage.TypeSRV, dnsmessage.RCodeSuccess, []string{"_sip._tcp.lan. 3600 SRV 10 5 5060 www.lan."}, true, false},
+		{"2.0.0.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"2.0.0.10.in-addr.arpa. 3600 PTR www.lan."}, true, false},
+		{"www.lan.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil, true, true},
+		{"_tcp.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil, true, true},
+		{"missing.lan.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil, true, true},
+		{"loop.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, repeat("loop.lan. 3600 CNAME loop.lan.", 8), true, true},
+
+		{"printer.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"printer.lan. 300 A 192.168.1.10"}, true, false},
+		{"printer.lan.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"printer.lan. 300 AAAA fd00::10"}, true, false},
+		{"printer.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"printer. 300 A 192.168.1.10"}, true, false},
+		{"printer.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil, true, false},
+		{"10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"10.1.168.192.in-addr.arpa. 300 PTR printer.lan."}, true, false},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess,
+			[]string{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. 300 PTR printer.lan."}, true, false},
+		{"blocked.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"blocked.example. 300 A 0.0.0.0"}, true, false},
+		{"0.0.0.0.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"0.0.0.0.in-addr.arpa. 300 A 1.2.3.4"}, false, false},
+
+		{"other.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"other.example. 300 A 1.2.3.4"}, false, false},
+	} {
+		resp := exchange(t, addr, newQuery(t, 1, tt.name, tt.typ))
+		if resp.RCode != tt.rcode || resp.Authoritative != tt.authoritative {
+			t.Errorf("%s %v: expected %v, authoritative %v, got %v, %v", tt.name, tt.typ, tt.rcode, tt.authoritative, resp.RCode, resp.Authoritative)
+		}
+		var answers []string
+		for _, rr := range resp.Answers {
+			answers = append(answers, formatRR(rr))
+		}
+		if strings.Join(answers, "\n") != strings.Join(tt.answers, "\n") {
+			t.Errorf("%s %v: expected answers\n%s\ngot\n%s", tt.name, tt.typ, strings.Join(tt.answers, "\n"), strings.Join(answers, "\n"))
+		}
+		hasSOA := len(resp.Authorities) == 1 && resp.Authorities[0].Header.Type == dnsmessage.TypeSOA
+		if hasSOA != tt.soa || hasSOA && resp.Authorities[0].Header.TTL != 60 {
+			t.Errorf("%s %v: expected soa %v with the minimum ttl, got %+v", tt.name, tt.typ, tt.soa, resp.Authorities)
+		}
+	}
+	// other.example., cdn.example. and the unspecified address
+	if n := u.queries.Load(); n != 3 {
+		t.Errorf("only the names which are not local should be forwarded, got %d queries", n)
+	}
+}
+
+func repeat(s string, n int) []string {
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = s
+	}
+	return ss
+}
+
+// formatRR returns a record as name ttl type data.
+func formatRR(rr dnsmessage.Resource) string {
+	var data string
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		data = net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		data = net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		data = body.CNAME.String()
+	case *dnsmessage.PTRResource:
+		data = body.PTR.String()
+	case *dnsmessage.MXResource:
+		data = strings.Join([]string{strconv.Itoa(int(body.Pref)), body.MX.String()}, " ")
+	case *dnsmessage.SRVResource:
+		data = strings.Join([]string{strconv.Itoa(int(body.Priority)), strconv.Itoa(int(body.Weight)), strconv.Itoa(int(body.Port)), body.Target.String()}, " ")
+	case *dnsmessage.TXTResource:
+		quoted := make([]string, len(body.TXT))
+		for i, s := range body.TXT {
+			quoted[i] = `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+		}
+		data = "[" + strings.Join(quoted, " ") + "]"
+	}
+	typ := strings.TrimPrefix(rr.Header.Type.String(), "Type")
+	return strings.Join([]string{rr.Header.Name.String(), strconv.Itoa(int(rr.Header.TTL)), typ, data}, " ")
+}
+
+func TestRecordsLookup(t *testing.T) {
+	records, err := socket.NewRecords([]io.Reader{strings.NewReader(testHosts)}, []io.Reader{strings.NewReader(testZone)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rrs, ok := records.Lookup("nas.lan", dnsmessage.TypeA); !ok || len(rrs) != 1 {
+		t.Errorf("nas.lan should have an A record, got %+v", rrs)
+	}
+	if rrs, ok := records.Lookup("www.lan", dnsmessage.TypeALL); !ok || len(rrs) != 2 {
+		t.Errorf("www.lan should have two records, got %+v", rrs)
+	}
+	if _, ok := records.Lookup("missing.lan", dnsmessage.TypeA); ok {
+		t.Error("missing.lan should not be found")
+	}
+	if _, ok := records.Lookup("linklocal.lan", dnsmessage.TypeAAAA); ok {
+		t.Error("addresses with a zone are skipped")
+	}
+	// 13 zone records, 5 addresses and 3 PTR of the hosts
+	if n, zones := records.Len(); n != 21 || zones != 1 {
+		t.Errorf("expected 21 records in 1 zone, got %d in %d", n, zones)
+	}
+}
+
+func TestZoneErrors(t *testing.T) {
+	for zone, want := range map[string]string{
+		"www 60 A 10.0.0.1\n":                            "line 1: relative name",
+		"$ORIGIN lan.\nwww A 10.0.0.1\n":                 "line 2: missing ttl",
+		"$ORIGIN lan.\n$TTL 1h\nwww A 10.0.0.300\n":      "line 3: A record: invalid ipv4",
+		"$ORIGIN lan.\n$TTL 1h\nwww MX mail\n":           "line 3: MX record: expected 2 fields",
+		"$ORIGIN lan.\n$TTL 1h\nwww CH A 10.0.0.1\n":     "line 3: unsupported class CH",
+		"$ORIGIN lan.\n$TTL 1h\nwww HINFO a b\n":         "line 3: HINFO record: unsupported type",
+		"$INCLUDE other.zone\n":                          "line 1: unsupported directive",
+		"$ORIGIN lan.\n$TTL 1h\n@ SOA ns admin (\n1 2\n": "line 4: unclosed parenthesis",
+		"$ORIGIN lan.\n$TTL 1h\ninfo TXT \"open\n":       "line 3: unclosed quote",
+		"$ORIGIN lan.\n$TTL 1x\n":                        "line 2: invalid ttl",
+		"\tA 10.0.0.1\n":                                 "line 1: no previous owner",
+	} {
+		_, err := socket.NewRecords(nil, []io.Reader{strings.NewReader(zone)})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected %q, got %v", zone, want, err)
+		}
+	}
+}
+
+func TestAuthorityArgs(t *testing.T) {
+	dir := t.TempDir()
+	hosts, zone := filepath.Join(dir, "hosts"), filepath.Join(dir, "lan.zone")
+	if err := os.WriteFile(hosts, []byte(testHosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zone, []byte(testZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Hosts: hosts, Zones: zone, Blocklists: hosts})
+
+	// the local records come before the blocklist
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "printer.lan.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 || !resp.Authoritative {
+		t.Errorf("printer.lan. should be answered from the hosts file: %+v", resp)
+	}
+	resp = exchange(t, s.Addr().String(), newQuery(t, 2, "mail.lan.", dnsmessage.TypeA))
+	if len(resp.Answers) != 1 || !resp.Authoritative {
+		t.Errorf("mail.lan. should be answered from the zone file: %+v", resp)
+	}
+	if n := u.queries.Load(); n != 0 {
+		t.Errorf("local names should not be forwarded, got %d queries", n)
+	}
+
+	if err := os.WriteFile(zone, []byte("bogus\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), zone) {
+		t.Errorf("expected the error of %s, got %v", zone, err)
+	}
+	resp = exchange(t, s.Addr().String(), newQuery(t, 3, "mail.lan.", dnsmessage.TypeA))
+	if len(resp.Answers) != 1 {
+		t.Errorf("the records in use should be kept when the reload fails: %+v", resp)
+	}
+
+	if _, err := socket.NewSocket(args.SocketArgs{Addr: "127.0.0.1:0", Network: "udp", DNSAddr: u.addr, Zones: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("a missing zone file should fail")
+	}
+}
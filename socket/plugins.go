@@ -0,0 +1,262 @@
+package socket
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type (
+	// Plugin is a stage of the chain of handlers answering the queries. It
+	// returns the handler of the stage, which answers a query itself or hands
+	// it to next, the handler of the following stage.
+	Plugin func(s *Socket, next Handler) Handler
+
+	// Recorder is a ResponseWriter keeping the response written through it,
+	// for the plugins acting on the responses of the next ones.
+	Recorder struct {
+		ResponseWriter
+		// Msg is the packed response, nil until one is written
+		Msg []byte
+	}
+)
+
+// DefaultPlugins returns the chain used when Options has no plugins nor
+// handler: queries are answered from the cache, or forwarded.
+func DefaultPlugins() []Plugin {
+	return []Plugin{Cache, Forward}
+}
+
+// chain builds the handler answering the queries from plugins, ending with
+// last. The queries reaching the end of the chain get a SERVFAIL.
+func (s *Socket) chain(plugins []Plugin, last Handler) Handler {
+	if plugins == nil && last == nil {
+		plugins = DefaultPlugins()
+	}
+	next := last
+	if next == nil {
+		next = HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+			s.WriteError(w, r, dnsmessage.RCodeServerFailure)
+		})
+	}
+	for i := len(plugins) - 1; i >= 0; i-- {
+		next = plugins[i](s, next)
+	}
+	return next
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w}
+}
+
+// WriteMsg packs m and writes it through Write.
+func (r *Recorder) WriteMsg(m *dnsmessage.Message) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = r.Write(b)
+	return err
+}
+
+// Write keeps b, which must not be modified afterwards, and writes it.
+func (r *Recorder) Write(b []byte) (int, error) {
+	r.Msg = b
+	return r.ResponseWriter.Write(b)
+}
+
+// RCode returns the rcode of the response, whose extended bits are left out.
+func (r *Recorder) RCode() dnsmessage.RCode {
+	if len(r.Msg) < 4 {
+		return 0
+	}
+	return dnsmessage.RCode(r.Msg[3] & 0x0f)
+}
+
+// inZone reports whether name is zone or one of its subdomains, both are
+// fully qualified and compared case insensitively.
+func inZone(name, zone string) bool {
+	if zone == "." {
+		return true
+	}
+	if len(name) < len(zone) || !strings.EqualFold(name[len(name)-len(zone):], zone) {
+		return false
+	}
+	return len(name) == len(zone) || name[len(name)-len(zone)-1] == '.'
+}
+
+// fqdn returns name with its trailing dot.
+func fqdn(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		return name + "."
+	}
+	return name
+}
+
+// Block returns a plugin answering NXDOMAIN to the queries for names and
+// their subdomains.
+func Block(names ...string) Plugin {
+	zones := make([]string, len(names))
+	for i, name := range names {
+		zones[i] = fqdn(name)
+	}
+	return func(s *Socket, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+			name := r.Questions[0].Name.String()
+			for _, zone := range zones {
+				if inZone(name, zone) {
+					s.WriteError(w, r, dnsmessage.RCodeNameError)
+					return
+				}
+			}
+			next.ServeDNS(ctx, w, r)
+		})
+	}
+}
+
+// Rewrite returns a plugin resolving the names under from as the same ones
+// under to: the next plugins get the rewritten query, and the names of the
+// response are rewritten back before it's sent to the client.
+func Rewrite(from, to string) Plugin {
+	from, to = fqdn(from), fqdn(to)
+	return func(s *Socket, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+			name := r.Questions[0].Name
+			rewritten, ok := replaceZone(name, from, to)
+			if !ok {
+				next.ServeDNS(ctx, w, r)
+				return
+			}
+			query := *r
+			query.Questions = append([]dnsmessage.Question{}, r.Questions...)
+			query.Questions[0].Name = rewritten
+			next.ServeDNS(ctx, &rewriteWriter{ResponseWriter: w, from: to, to: from}, &query)
+		})
+	}
+}
+
+// replaceZone replaces the zone suffix of name by to, it reports false if
+// name is not in zone.
+func replaceZone(name dnsmessage.Name, zone, to string) (dnsmessage.Name, bool) {
+	s := name.String()
+	if !inZone(s, zone) {
+		return name, false
+	}
+	n, err := dnsmessage.NewName(strings.TrimSuffix(s[:len(s)-len(zone)]+to, ".") + ".")
+	if err != nil {
+		return name, false
+	}
+	return n, true
+}
+
+// rewriteWriter rewrites the owner names of a response from a zone to
+// another.
+type rewriteWriter struct {
+	ResponseWriter
+	from, to string
+}
+
+func (w *rewriteWriter) WriteMsg(m *dnsmessage.Message) error {
+	resp := *m
+	resp.Questions = append([]dnsmessage.Question{}, m.Questions...)
+	for i := range resp.Questions {
+		resp.Questions[i].Name, _ = replaceZone(resp.Questions[i].Name, w.from, w.to)
+	}
+	for _, rs := range []*[]dnsmessage.Resource{&resp.Answers, &resp.Authorities, &resp.Additionals} {
+		renamed := append([]dnsmessage.Resource{}, *rs...)
+		for i := range renamed {
+			renamed[i].Header.Name, _ = replaceZone(renamed[i].Header.Name, w.from, w.to)
+		}
+		*rs = renamed
+	}
+	return w.ResponseWriter.WriteMsg(&resp)
+}
+
+func (w *rewriteWriter) Write(b []byte) (int, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(&m)
+}
+
+// Log is a plugin logging each query with its response code and how long it
+// took to answer.
+func Log(s *Socket, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+		start := time.Now()
+		rec := NewRecorder(w)
+		next.ServeDNS(ctx, rec, r)
+		rcode := "dropped"
+		if rec.Msg != nil {
+			rcode = rec.RCode().String()
+		}
+		q := r.Questions[0]
+		s.log.Printf("%v %s %s %s %s\n", w.RemoteAddr(), q.Name, q.Type, rcode, time.Since(start))
+	})
+}
+
+type (
+	// Metrics counts the queries going through its Plugin.
+	Metrics struct {
+		mu     sync.Mutex
+		counts QueryCounts
+	}
+
+	// QueryCounts are the counters of Metrics.
+	QueryCounts struct {
+		Queries uint64
+		ByType  map[dnsmessage.Type]uint64
+		ByRCode map[dnsmessage.RCode]uint64
+		// Dropped is the number of queries which got no response
+		Dropped uint64
+		// Duration is the time spent answering the queries
+		Duration time.Duration
+	}
+)
+
+// Plugin is the plugin counting the queries, and their responses written by
+// the next plugins.
+func (m *Metrics) Plugin(s *Socket, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+		start := time.Now()
+		rec := NewRecorder(w)
+		next.ServeDNS(ctx, rec, r)
+		d := time.Since(start)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.counts.ByType == nil {
+			m.counts.ByType = make(map[dnsmessage.Type]uint64)
+			m.counts.ByRCode = make(map[dnsmessage.RCode]uint64)
+		}
+		m.counts.Queries++
+		m.counts.ByType[r.Questions[0].Type]++
+		if rec.Msg == nil {
+			m.counts.Dropped++
+		} else {
+			m.counts.ByRCode[rec.RCode()]++
+		}
+		m.counts.Duration += d
+	})
+}
+
+// Counts returns a copy of the counters.
+func (m *Metrics) Counts() QueryCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counts
+	c.ByType = make(map[dnsmessage.Type]uint64, len(m.counts.ByType))
+	for k, v := range m.counts.ByType {
+		c.ByType[k] = v
+	}
+	c.ByRCode = make(map[dnsmessage.RCode]uint64, len(m.counts.ByRCode))
+	for k, v := range m.counts.ByRCode {
+		c.ByRCode[k] = v
+	}
+	return c
+}
@@ -0,0 +1,147 @@
+package socket_test
+
+import (
+	"context"
+	"dns-resolver/socket"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// servePlugins serves a socket made with opts over udp, returning its address.
+func servePlugins(t *testing.T, opts socket.Options) string {
+	t.Helper()
+	s, err := socket.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(s) })
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(context.Background(), pc)
+	return pc.LocalAddr().String()
+}
+
+func TestPluginsOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	stage := func(name string) socket.Plugin {
+		return func(s *socket.Socket, next socket.Handler) socket.Handler {
+			return socket.HandlerFunc(func(ctx context.Context, w socket.ResponseWriter, r *dnsmessage.Message) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next.ServeDNS(ctx, w, r)
+			})
+		}
+	}
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Plugins:   []socket.Plugin{stage("first"), stage("second")},
+	})
+
+	// without handler the end of the chain answers SERVFAIL
+	resp := exchange(t, addr, newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", resp.RCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("plugins called in the wrong order: %q", order)
+	}
+}
+
+func TestBlockPlugin(t *testing.T) {
+	u := startUpstream(t, nil)
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		Plugins:   []socket.Plugin{socket.Block("ads.example"), socket.Forward},
+	})
+
+	for _, name := range []string{"ads.example.", "x.ADS.example."} {
+		resp := exchange(t, addr, newEDNSQuery(t, 2, name, dnsmessage.TypeA, 1232, 0))
+		if resp.RCode != dnsmessage.RCodeNameError || len(resp.Answers) != 0 {
+			t.Errorf("%s should be blocked: %+v", name, resp)
+		}
+		if len(resp.Additionals) != 1 || resp.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+			t.Errorf("%s: the response should have an OPT record", name)
+		}
+	}
+	if n := u.queries.Load(); n != 0 {
+		t.Errorf("blocked queries should not be forwarded, got %d", n)
+	}
+	resp := exchange(t, addr, newQuery(t, 3, "notads.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Errorf("notads.example. should not be blocked: %+v", resp)
+	}
+}
+
+func TestRewritePlugin(t *testing.T) {
+	names := make(chan string, 1)
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		names <- q.Questions[0].Name.String()
+		return answerA([4]byte{10, 0, 0, 1}, 300)(q)
+	})
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		Plugins:   []socket.Plugin{socket.Cache, socket.Rewrite("corp", "internal.example"), socket.Forward},
+	})
+
+	for i := 0; i < 2; i++ {
+		resp := exchange(t, addr, newQuery(t, uint16(i), "host.corp.", dnsmessage.TypeA))
+		if len(resp.Answers) != 1 || resp.Questions[0].Name.String() != "host.corp." ||
+			resp.Answers[0].Header.Name.String() != "host.corp." {
+			t.Fatalf("names should be rewritten back: %+v", resp)
+		}
+	}
+	if name := <-names; name != "host.internal.example." {
+		t.Errorf("upstream got %s", name)
+	}
+	// the second query is answered from the cache
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestLogAndMetricsPlugins(t *testing.T) {
+	u := startUpstream(t, nil)
+	logger := &recordLogger{}
+	metrics := &socket.Metrics{}
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		Logger:    logger,
+		Plugins: []socket.Plugin{
+			socket.Log, metrics.Plugin, socket.Block("blocked.example"), socket.Cache, socket.Forward,
+		},
+	})
+
+	exchange(t, addr, newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	exchange(t, addr, newQuery(t, 2, "a.example.", dnsmessage.TypeA))
+	exchange(t, addr, newQuery(t, 3, "blocked.example.", dnsmessage.TypeAAAA))
+
+	// the plugins are done once the response is written
+	for deadline := time.Now().Add(5 * time.Second); metrics.Counts().Queries < 3 || !logger.contains("blocked"); {
+		if time.Now().After(deadline) {
+			t.Fatal("queries not counted nor logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c := metrics.Counts()
+	if c.Queries != 3 || c.ByType[dnsmessage.TypeA] != 2 || c.ByType[dnsmessage.TypeAAAA] != 1 {
+		t.Errorf("bad query counts: %+v", c)
+	}
+	if c.ByRCode[dnsmessage.RCodeSuccess] != 2 || c.ByRCode[dnsmessage.RCodeNameError] != 1 || c.Dropped != 0 {
+		t.Errorf("bad rcode counts: %+v", c)
+	}
+	if !logger.contains("blocked.example. TypeAAAA RCodeNameError") {
+		t.Errorf("query not logged: %q", logger.lines)
+	}
+}
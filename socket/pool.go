@@ -0,0 +1,384 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxUDPSize is the largest dns message a udp datagram can carry
+	maxUDPSize = 65535
+	// udpConnMaxQueries and udpConnMaxAge bound the use of a udp socket, so
+	// that the source port of the queries changes often: along with their
+	// random id, it's what a spoofed reply has to guess
+	udpConnMaxQueries = 32
+	udpConnMaxAge     = 5 * time.Second
+)
+
+type (
+	// connPool keeps up to size long lived connections to an upstream, the
+	// udp ones being renewed after a few queries. The queries in flight on a
+	// connection are told apart by their id, which the pool keeps unique
+	// among them.
+	connPool struct {
+		addr    string
+		network string
+		size    int
+		timeout time.Duration
+		// dial opens a new connection to addr
+		dial func() (net.Conn, error)
+		log  Logger
+
+		mu      sync.Mutex
+		conns   []*pooledConn
+		dialing int
+
+		dials  atomic.Uint64
+		reuses atomic.Uint64
+		errors atomic.Uint64
+	}
+
+	// pooledConn is a connection of a connPool, its responses are read by
+	// readLoop and handed to the query waiting for their id.
+	pooledConn struct {
+		pool    *connPool
+		conn    net.Conn
+		stream  bool
+		created time.Time
+
+		writeMu sync.Mutex
+		mu      sync.Mutex
+		pending map[uint16]*pendingQuery
+		queries int
+		// retired is set once the connection is taken out of the pool, it's
+		// closed when its last query is done
+		retired bool
+		// err is set once the connection broke, it's not used anymore then
+		err error
+	}
+
+	pendingQuery struct {
+		q    *upstreamQuery
+		resp chan []byte
+	}
+
+	// PoolStats describes the connections kept to an upstream.
+	PoolStats struct {
+		Upstream string
+		Network  string
+		// Open is the number of connections currently open
+		Open int
+		// InFlight is the number of queries waiting for a response
+		InFlight int
+		// Dials is the number of connections opened so far
+		Dials uint64
+		// Reuses is the number of queries sent over an already open connection
+		Reuses uint64
+		// Errors is the number of failed dials and broken connections
+		Errors uint64
+	}
+)
+
+func newConnPool(network, addr string, size int, timeout time.Duration, logger Logger) *connPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &connPool{
+		addr:    addr,
+		network: network,
+		size:    size,
+		timeout: timeout,
+		dial: func() (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		},
+		log: logger,
+	}
+}
+
+// exchange sends q over one of the pool connections and waits for a response
+// matching it, up to the pool timeout.
+func (p *connPool) exchange(q *upstreamQuery) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.exchange(q, p.timeout)
+		// a kept connection may have been closed by the upstream while idle,
+		// the query is sent again once over a new one
+		if err != nil && attempt == 0 && c.broken() && !errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// get returns the least busy connection, a new one is dialed when they are
+// all busy and the pool isn't full yet.
+func (p *connPool) get() (*pooledConn, error) {
+	p.mu.Lock()
+	var (
+		best     *pooledConn
+		bestLoad int
+	)
+	for _, c := range p.conns {
+		if c.broken() {
+			continue
+		}
+		if n := c.inFlight(); best == nil || n < bestLoad {
+			best, bestLoad = c, n
+		}
+	}
+	if best != nil && (bestLoad == 0 || len(p.conns)+p.dialing >= p.size) {
+		p.mu.Unlock()
+		p.reuses.Add(1)
+		return best, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		p.errors.Add(1)
+		if best != nil {
+			p.reuses.Add(1)
+			return best, nil
+		}
+		return nil, err
+	}
+	p.dials.Add(1)
+
+	c := &pooledConn{
+		pool:    p,
+		conn:    conn,
+		stream:  p.network != "udp",
+		created: time.Now(),
+		pending: make(map[uint16]*pendingQuery),
+	}
+	p.conns = append(p.conns, c)
+	go c.readLoop()
+	return c, nil
+}
+
+func (p *connPool) remove(c *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.conns {
+		if p.conns[i] == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// close closes the pool connections, the queries waiting on them fail.
+func (p *connPool) close() {
+	p.mu.Lock()
+	conns := make([]*pooledConn, len(p.conns))
+	copy(conns, p.conns)
+	p.mu.Unlock()
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+}
+
+func (p *connPool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := PoolStats{
+		Upstream: p.addr,
+		Network:  p.network,
+		Open:     len(p.conns),
+		Dials:    p.dials.Load(),
+		Reuses:   p.reuses.Load(),
+		Errors:   p.errors.Load(),
+	}
+	for _, c := range p.conns {
+		st.InFlight += c.inFlight()
+	}
+	return st
+}
+
+func (c *pooledConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *pooledConn) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *pooledConn) exchange(q *upstreamQuery, timeout time.Duration) ([]byte, error) {
+	pq := &pendingQuery{q: q, resp: make(chan []byte, 1)}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	var id uint16
+	for {
+		var err error
+		if id, err = randomID(); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		if _, used := c.pending[id]; !used {
+			break
+		}
+	}
+	q.setID(id)
+	c.pending[id] = pq
+	c.queries++
+	// udp sockets are replaced after a while, this query is the last one
+	retire := !c.stream && !c.retired &&
+		(c.queries >= udpConnMaxQueries || time.Since(c.created) >= udpConnMaxAge)
+	if retire {
+		c.retired = true
+	}
+	c.mu.Unlock()
+	if retire {
+		c.pool.remove(c)
+	}
+	defer func() {
+		c.mu.Lock()
+		if c.pending[id] == pq {
+			delete(c.pending, id)
+		}
+		closing := c.retired && c.err == nil && len(c.pending) == 0
+		if closing {
+			c.err = fmt.Errorf("connection to %s: %w", c.pool.addr, net.ErrClosed)
+		}
+		c.mu.Unlock()
+		if closing {
+			if err := c.conn.Close(); err != nil {
+				c.pool.log.Println(err)
+			}
+		}
+	}()
+
+	if err := c.write(q.msg, timeout); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-pq.resp:
+		if !ok {
+			return nil, c.err
+		}
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("exchange with %s: %w", c.pool.addr, os.ErrDeadlineExceeded)
+	}
+}
+
+func (c *pooledConn) write(msg []byte, timeout time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if c.stream {
+		return writeTCPMsg(c.conn, msg)
+	}
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// readLoop hands the responses read from the connection to the queries
+// waiting for them, until the connection breaks.
+func (c *pooledConn) readLoop() {
+	buf := make([]byte, maxUDPSize)
+	for {
+		var (
+			msg []byte
+			err error
+		)
+		if c.stream {
+			msg, err = readTCPMsg(c.conn, func(n int) []byte { return make([]byte, n) })
+		} else {
+			var n int
+			if n, err = c.conn.Read(buf); err == nil {
+				msg = make([]byte, n)
+				copy(msg, buf[:n])
+			}
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(msg) < 2 {
+			continue
+		}
+
+		c.mu.Lock()
+		pq, ok := c.pending[binary.BigEndian.Uint16(msg)]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := pq.q.check(msg); err != nil {
+			c.pool.log.Printf("dropped reply from %s: %v\n", c.pool.addr, err)
+			continue
+		}
+		c.mu.Lock()
+		// the query may have given up meanwhile, and only the first valid
+		// reply is kept
+		if c.pending[pq.q.id] == pq {
+			select {
+			case pq.resp <- msg:
+			default:
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fail closes a broken connection, the queries waiting on it fail right away.
+func (c *pooledConn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = fmt.Errorf("connection to %s: %w", c.pool.addr, err)
+	for id, pq := range c.pending {
+		close(pq.resp)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	c.pool.remove(c)
+	c.pool.errors.Add(1)
+	if err := c.conn.Close(); err != nil {
+		c.pool.log.Println(err)
+	}
+}
+
+// PoolStats returns statistics about the upstream connection pools.
+func (s *Socket) PoolStats() []PoolStats {
+	stats := make([]PoolStats, 0, 2*len(s.upstreams))
+	for _, u := range s.upstreams {
+		stats = append(stats, u.udp.stats())
+		// encrypted upstreams carry both over the same connections
+		if u.tcp != u.udp {
+			stats = append(stats, u.tcp.stats())
+		}
+	}
+	return stats
+}
@@ -0,0 +1,70 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPoolReusesConnections(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:       u.addr,
+		Workers:       8,
+		UpstreamConns: 2,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.", i)
+			resp := exchange(t, s.Addr().String(), newQuery(t, uint16(i), name, dnsmessage.TypeA))
+			if resp.ID != uint16(i) || len(resp.Answers) != 1 || resp.Answers[0].Header.Name.String() != name {
+				t.Errorf("bad response for %s: %+v", name, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, st := range s.PoolStats() {
+		if st.Network != "udp" {
+			continue
+		}
+		// the udp sockets are replaced every 32 queries
+		if st.Dials == 0 || st.Dials > 4 {
+			t.Errorf("pool should have dialed 1 to 4 connections, got %d", st.Dials)
+		}
+		if st.Dials+st.Reuses != 50 {
+			t.Errorf("every query should have used the pool: %+v", st)
+		}
+		if st.InFlight != 0 || st.Open == 0 || st.Open > 2 {
+			t.Errorf("bad pool state: %+v", st)
+		}
+	}
+}
+
+func TestPoolRenewsUDPSockets(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, UpstreamConns: 1})
+
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("host%d.example.", i)
+		if resp := exchange(t, s.Addr().String(), newQuery(t, uint16(i), name, dnsmessage.TypeA)); len(resp.Answers) != 1 {
+			t.Fatalf("bad response for %s: %+v", name, resp)
+		}
+	}
+	for _, st := range s.PoolStats() {
+		if st.Network != "udp" {
+			continue
+		}
+		// the source port changes once the first socket sent 32 queries
+		if st.Dials != 2 || st.Open != 1 || st.Errors != 0 {
+			t.Errorf("the socket should have been replaced once: %+v", st)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// metricsPath is where the metrics are served
+	metricsPath = "/metrics"
+	// metricsType is the media type of the prometheus text format
+	metricsType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms
+var durationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type (
+	// serverMetrics are the counters and histograms exported by
+	// MetricsHandler, the gauges are read when it's called.
+	serverMetrics struct {
+		queries          *metricVec
+		queryDuration    *metricVec
+		cacheRequests    *metricVec
+		upstreamRequests *metricVec
+		upstreamDuration *metricVec
+		reloads          *metricVec
+	}
+
+	// metricVec is a counter, or a histogram when it has buckets, with a
+	// series for each set of label values.
+	metricVec struct {
+		name, help string
+		labels     []string
+		buckets    []float64
+		mu         sync.Mutex
+		series     map[string]*series
+	}
+
+	series struct {
+		values []string
+		// count is the counter value, or the number of observations of a
+		// histogram, whose sum and count per bucket are in sum and buckets
+		count   uint64
+		sum     float64
+		buckets []uint64
+	}
+)
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		queries: newMetricVec("dns_queries_total", "Queries answered, by client protocol, type and response code.",
+			nil, "protocol", "qtype", "rcode"),
+		queryDuration: newMetricVec("dns_query_duration_seconds", "Time taken to answer the queries, by client protocol.",
+			durationBuckets, "protocol"),
+		cacheRequests: newMetricVec("dns_cache_requests_total", "Cache lookups, by result.",
+			nil, "result"),
+		upstreamRequests: newMetricVec("dns_upstream_requests_total", "Exchanges with the upstreams, by upstream, protocol and result.",
+			nil, "upstream", "protocol", "result"),
+		upstreamDuration: newMetricVec("dns_upstream_duration_seconds", "Round trip time of the exchanges answered by the upstreams.",
+			durationBuckets, "upstream", "protocol"),
+		reloads: newMetricVec("dns_reloads_total", "Reloads of the local records, block and allow lists, by result.",
+			nil, "result"),
+	}
+}
+
+func newMetricVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get returns the series of values, m.mu must be held.
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values}
+		if m.buckets != nil {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc increments the counter of values.
+func (m *metricVec) inc(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).count++
+}
+
+// observe adds d to the histogram of values.
+func (m *metricVec) observe(d time.Duration, values ...string) {
+	v := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	s.count++
+	s.sum += v
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// write writes the series in the prometheus text format, sorted by label
+// values.
+func (m *metricVec) write(w io.Writer) {
+	kind := "counter"
+	if m.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.values)
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %d\n", m.name, labels, s.count)
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(labels, "le", formatFloat(le)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns {name="value",...}, or nothing without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds a label to the ones formatted by formatLabels.
+func withLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=\"%s\"", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// writeCounter writes a counter without labels.
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// typeName returns the name of a query type, A for TypeA, or its number.
+func typeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// rcodeName returns the mnemonic of a response code, or its number.
+func rcodeName(rcode dnsmessage.RCode) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(int(rcode))
+}
+
+// MetricsHandler returns the handler exporting the metrics of the server in
+// the prometheus text format: queries by client protocol, type and response
+// code, queries coalesced with an identical one, cache hits and misses, exchanges with the upstreams and their
+// latency, reloads, along with the size of the cache, of the queue and the number of
+// busy workers.
+func (s *Socket) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsType)
+		b := bufio.NewWriter(w)
+		s.metrics.queries.write(b)
+		s.metrics.queryDuration.write(b)
+		writeCounter(b, "dns_queries_coalesced_total", "Queries answered with the response of an identical query in flight.",
+			s.flights.stats().Deduplicated)
+		for _, m := range []*metricVec{
+			s.metrics.cacheRequests, s.metrics.upstreamRequests, s.metrics.upstreamDuration, s.metrics.reloads,
+		} {
+			m.write(b)
+		}
+		writeGauge(b, "dns_cache_entries", "Responses in the cache.", s.cache.Len())
+		writeGauge(b, "dns_cache_capacity", "Responses the cache holds at most.", s.opts.CacheSize)
+		writeGauge(b, "dns_queue_length", "Queries waiting for a worker.", len(s.queue))
+		writeGauge(b, "dns_queue_capacity", "Queries the queue holds at most.", cap(s.queue))
+		writeGauge(b, "dns_workers_active", "Workers handling a query.", int(s.activeWorkers.Load()))
+		writeGauge(b, "dns_workers", "Workers handling the queries.", s.opts.Workers)
+		if err := b.Flush(); err != nil {
+			s.log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, MetricsAddr: "127.0.0.1:0"})
+
+	exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	exchange(t, s.Addr().String(), newQuery(t, 2, "a.example.", dnsmessage.TypeA))
+
+	want := []string{
+		`dns_queries_total{protocol="udp",qtype="A",rcode="NOERROR"} 2`,
+		`dns_query_duration_seconds_count{protocol="udp"} 2`,
+		`dns_query_duration_seconds_bucket{protocol="udp",le="+Inf"} 2`,
+		"dns_queries_coalesced_total 0",
+		`dns_cache_requests_total{result="hit"} 1`,
+		`dns_cache_requests_total{result="miss"} 1`,
+		`dns_upstream_requests_total{upstream="` + u.addr + `",protocol="udp",result="success"} 1`,
+		`dns_upstream_duration_seconds_count{upstream="` + u.addr + `",protocol="udp"} 1`,
+		"# TYPE dns_upstream_duration_seconds histogram",
+		"dns_cache_entries 1",
+		"dns_queue_capacity 8",
+		"dns_workers 2",
+	}
+	url := "http://" + s.MetricsAddr().String() + "/metrics"
+	// the queries are counted once their response is sent
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		body = string(b)
+		if strings.Contains(body, want[0]) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsDuringCacheWrites(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	done := make(chan struct{})
+	scraped := make(chan struct{})
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+			rec := httptest.NewRecorder()
+			s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		exchange(t, s.Addr().String(), newQuery(t, uint16(i), fmt.Sprintf("host%d.example.", i), dnsmessage.TypeA))
+	}
+	close(done)
+	<-scraped
+}
+
+func TestMetricsCoalesced(t *testing.T) {
+	answer := answerA([4]byte{1, 2, 3, 4}, 300)
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		time.Sleep(200 * time.Millisecond)
+		return answer(q)
+	})
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr, Workers: 8})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			exchange(t, s.Addr().String(), newQuery(t, id, "popular.example.", dnsmessage.TypeA))
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := "\ndns_queries_coalesced_total 4\n"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics miss %q:\n%s", want, rec.Body.String())
+	}
+}
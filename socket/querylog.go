@@ -0,0 +1,233 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// QueryRecord is the log record of a query, written by QueryLog as a
+	// json line.
+	QueryRecord struct {
+		Time     time.Time `json:"time"`
+		Client   string    `json:"client,omitempty"`
+		Protocol string    `json:"protocol"`
+		Name     string    `json:"qname"`
+		Type     string    `json:"qtype"`
+		// RCode is "dropped" when the query got no response
+		RCode    string `json:"rcode"`
+		CacheHit bool   `json:"cache_hit"`
+		// Upstream is the one the response came from, empty if it was not
+		// forwarded
+		Upstream string `json:"upstream,omitempty"`
+		// Latency is the time taken to answer, in milliseconds
+		Latency float64 `json:"latency_ms"`
+		Size    int     `json:"size"`
+	}
+
+	// QueryLog writes a QueryRecord for a sample of the queries, one json
+	// object per line.
+	QueryLog struct {
+		mu     sync.Mutex
+		w      io.Writer
+		sample float64
+	}
+
+	// queryInfo is what the plugins tell the query log about a query, it's
+	// found in the context of the sampled queries.
+	queryInfo struct {
+		cacheHit bool
+		upstream string
+	}
+
+	queryInfoKey struct{}
+
+	// RotatingFile is a file rotated once it grows over its maximum size, or
+	// when Rotate is called: it's renamed with a .1 suffix, the previous
+	// backups being shifted to .2 and so on, and the oldest removed.
+	RotatingFile struct {
+		path    string
+		maxSize int64
+		backups int
+
+		mu   sync.Mutex
+		f    *os.File
+		size int64
+		// rotateFailed is set once a rotation by Write failed, until one
+		// succeeds
+		rotateFailed bool
+	}
+)
+
+// NewQueryLog returns a query log writing to w. sample is the fraction of the
+// queries logged, every query is logged if it's not in (0, 1).
+func NewQueryLog(w io.Writer, sample float64) *QueryLog {
+	if sample <= 0 || sample > 1 {
+		sample = 1
+	}
+	return &QueryLog{w: w, sample: sample}
+}
+
+// sampled reports whether the next query should be logged.
+func (l *QueryLog) sampled() bool {
+	return l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// Log writes r, in a single write.
+func (l *QueryLog) Log(r *QueryRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(b)
+	return err
+}
+
+// withQueryInfo returns a context carrying a queryInfo.
+func withQueryInfo(ctx context.Context) (context.Context, *queryInfo) {
+	info := &queryInfo{}
+	return context.WithValue(ctx, queryInfoKey{}, info), info
+}
+
+// queryInfoFrom returns the queryInfo of a query, nil if it's not logged.
+func queryInfoFrom(ctx context.Context) *queryInfo {
+	info, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return info
+}
+
+// OpenQueryLog opens the destination of a query log: "stdout", "syslog" or
+// the path of a file, rotated once it's over maxSize bytes (never if zero)
+// keeping backups old files.
+func OpenQueryLog(dest string, maxSize int64, backups int) (io.WriteCloser, error) {
+	switch dest {
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "syslog":
+		return openSyslog()
+	default:
+		return OpenRotatingFile(dest, maxSize, backups)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// OpenRotatingFile opens path for appending, creating it if needed.
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends b, rotating the file first if b would make it too big. If
+// the rotation fails b is appended anyway, the error being returned by the
+// first write it fails only.
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return 0, fmt.Errorf("write %s: %w", f.path, os.ErrClosed)
+	}
+	var rotateErr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			if f.f == nil {
+				return 0, err
+			}
+			if !f.rotateFailed {
+				rotateErr = fmt.Errorf("rotate %s: %w", f.path, err)
+			}
+			f.rotateFailed = true
+		} else {
+			f.rotateFailed = false
+		}
+	}
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Rotate moves the file to its first backup and starts a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return fmt.Errorf("rotate %s: %w", f.path, os.ErrClosed)
+	}
+	return f.rotate()
+}
+
+// rotate closes the file, moves it to its first backup and opens the path
+// again: if the file couldn't be moved, it goes on being written.
+func (f *RotatingFile) rotate() error {
+	err := f.f.Close()
+	f.f = nil
+	if err == nil {
+		err = f.shift()
+	}
+	if oerr := f.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// shift moves the file and its backups one backup further, removing the
+// oldest one.
+func (f *RotatingFile) shift() error {
+	if f.backups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := f.backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+// Close closes the file, writes fail afterwards.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package socket
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on this system")
+}
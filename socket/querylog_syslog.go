@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package socket
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the local syslog daemon, the records are sent with
+// the info severity.
+func openSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "dns-resolver")
+}
@@ -0,0 +1,193 @@
+package socket_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"dns-resolver/socket"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while the socket writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []socket.QueryRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []socket.QueryRecord
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var r socket.QueryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestQueryLog(t *testing.T) {
+	u := startUpstream(t, nil)
+	buf := &syncBuffer{}
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		QueryLog:  socket.NewQueryLog(buf, 1),
+	})
+
+	exchange(t, addr, newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	exchange(t, addr, newQuery(t, 2, "a.example.", dnsmessage.TypeA))
+
+	var records []socket.QueryRecord
+	for deadline := time.Now().Add(5 * time.Second); len(records) < 2; records = buf.records(t) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queries not logged: %+v", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, r := range records {
+		if r.Name != "a.example." || r.Type != "A" || r.RCode != "NOERROR" || r.Protocol != "udp" ||
+			r.Client == "" || r.Size == 0 || r.Latency <= 0 || time.Since(r.Time) > time.Minute {
+			t.Errorf("bad record %d: %+v", i, r)
+		}
+	}
+	if records[0].CacheHit || records[0].Upstream != u.addr {
+		t.Errorf("the first query should be forwarded: %+v", records[0])
+	}
+	if !records[1].CacheHit || records[1].Upstream != "" {
+		t.Errorf("the second query should hit the cache: %+v", records[1])
+	}
+}
+
+func TestQueryLogSample(t *testing.T) {
+	buf := &syncBuffer{}
+	logged := make(chan struct{}, 10)
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Handler: socket.HandlerFunc(func(ctx context.Context, w socket.ResponseWriter, r *dnsmessage.Message) {
+			logged <- struct{}{}
+			w.WriteMsg(&dnsmessage.Message{Header: dnsmessage.Header{ID: r.ID, Response: true}, Questions: r.Questions})
+		}),
+		QueryLog: socket.NewQueryLog(buf, 1e-9),
+	})
+	for i := 0; i < 10; i++ {
+		exchange(t, addr, newQuery(t, uint16(i), "a.example.", dnsmessage.TypeA))
+		<-logged
+	}
+	time.Sleep(50 * time.Millisecond)
+	if records := buf.records(t); len(records) != 0 {
+		t.Errorf("no query should be sampled, got %d", len(records))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := socket.OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%s holds %q (%v), expected %q", filepath.Base(name), b, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 backups should be kept: %v", err)
+	}
+
+	if err := f.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "fourth\n" {
+		t.Errorf("rotate should move the file to its first backup, it holds %q", b)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("rotate should start a new file: %v", err)
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := socket.OpenRotatingFile(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the file can't be moved over a non empty directory
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Rotate(); err == nil {
+		t.Fatal("rotate should fail")
+	}
+	if _, err := f.Write([]byte("second\n")); err != nil {
+		t.Fatalf("the file should be written after a failed rotation: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "first\nsecond\n" {
+		t.Errorf("the file holds %q", b)
+	}
+}
+
+func TestRotatingFileWriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := socket.OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the failed rotation is reported once, the lines are written anyway
+	if n, err := f.Write([]byte("second\n")); err == nil || n != 7 {
+		t.Errorf("the failed rotation should be reported after the line is written: %d, %v", n, err)
+	}
+	if _, err := f.Write([]byte("third\n")); err != nil {
+		t.Errorf("the failed rotation should be reported once: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "first\nsecond\nthird\n" {
+		t.Errorf("the file holds %q", b)
+	}
+
+	// the rotation is done once it succeeds again
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "fourth\n" {
+		t.Errorf("the file should be rotated, it holds %q", b)
+	}
+}
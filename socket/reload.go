@@ -0,0 +1,51 @@
+package socket
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reloader is what Socket.Reload reloads, the Blocker of LoadBlocker is one.
+// Reload must keep what it holds in use when it fails, and be safe to call
+// while the queries are being answered.
+type Reloader interface {
+	Reload() error
+}
+
+// Reload reloads every reloader of the options, logging what each one holds
+// once reloaded or why it failed. It returns the first error, after trying
+// all of them.
+func (s *Socket) Reload() error {
+	var first error
+	for _, r := range s.opts.Reloaders {
+		start := time.Now()
+		if err := r.Reload(); err != nil {
+			s.metrics.reloads.inc("failure")
+			err = fmt.Errorf("reload: %w", err)
+			s.log.Println(err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		s.metrics.reloads.inc("success")
+		if str, ok := r.(fmt.Stringer); ok {
+			s.log.Printf("reloaded %s in %v\n", str, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return first
+}
+
+// reloader reloads each ReloadInterval, until Shutdown.
+func (s *Socket) reloader() {
+	ticker := time.NewTicker(s.opts.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.Reload()
+	}
+}
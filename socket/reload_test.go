@@ -0,0 +1,227 @@
+package socket_test
+
+import (
+	"dns-resolver/socket"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// listServer serves a list over http, failing with a 500 while it's empty.
+type listServer struct {
+	*httptest.Server
+	list atomic.Pointer[string]
+}
+
+func startListServer(t *testing.T, list string) *listServer {
+	t.Helper()
+	s := &listServer{}
+	s.set(list)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := *s.list.Load()
+		if list == "" {
+			http.Error(w, "no list", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, list)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *listServer) set(list string) {
+	s.list.Store(&list)
+}
+
+func TestBlockerReload(t *testing.T) {
+	srv := startListServer(t, "||one.example^\n")
+	blocker, err := socket.LoadBlocker([]string{srv.URL}, nil, "nxdomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocker.Blocklist().Blocked("one.example.") {
+		t.Fatal("one.example. should be blocked")
+	}
+
+	srv.set("two.example\nthree.example\n")
+	if err := blocker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	list := blocker.Blocklist()
+	if list.Blocked("one.example.") || !list.Blocked("two.example.") {
+		t.Error("the reloaded list should replace the previous one")
+	}
+	if blocker.String() != "blocklist of 2 blocking and 0 allowing rules" {
+		t.Errorf("unexpected description %q", blocker.String())
+	}
+
+	srv.set("")
+	err = blocker.Reload()
+	if err == nil || !strings.Contains(err.Error(), srv.URL) || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected the status of %s, got %v", srv.URL, err)
+	}
+	if blocker.Blocklist() != list {
+		t.Error("the list in use should be kept when the reload fails")
+	}
+
+	if _, err := socket.LoadBlocker([]string{srv.URL, "/nonexistent"}, nil, "nxdomain"); err == nil {
+		t.Error("a missing list should fail")
+	}
+}
+
+func TestReloadUnderLoad(t *testing.T) {
+	srv := startListServer(t, "||ads.example^\n")
+	blocker, err := socket.LoadBlocker([]string{srv.URL}, nil, "nxdomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := startUpstream(t, nil)
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{u.addr},
+		Plugins:   []socket.Plugin{blocker.Plugin, socket.Forward},
+		Reloaders: []socket.Reloader{blocker},
+		Logger:    &recordLogger{},
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			srv.set(fmt.Sprintf("||ads.example^\nhost%d.example\n", i))
+			if err := blocker.Reload(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- func() error {
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				buf := make([]byte, 512)
+				for j := 0; j < 50; j++ {
+					name, want := "ads.example.", dnsmessage.RCodeNameError
+					if j%2 == 1 {
+						name, want = "ok.example.", dnsmessage.RCodeSuccess
+					}
+					conn.SetDeadline(time.Now().Add(5 * time.Second))
+					if _, err := conn.Write(newQuery(t, uint16(i<<8|j), name, dnsmessage.TypeA)); err != nil {
+						return err
+					}
+					n, err := conn.Read(buf)
+					if err != nil {
+						return fmt.Errorf("query %d of %d: %w", j, i, err)
+					}
+					var resp dnsmessage.Message
+					if err := resp.Unpack(buf[:n]); err != nil {
+						return err
+					}
+					if resp.RCode != want {
+						return fmt.Errorf("%s: expected %v, got %v", name, want, resp.RCode)
+					}
+				}
+				return nil
+			}()
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadInterval(t *testing.T) {
+	srv := startListServer(t, "one.example\n")
+	blocker, err := socket.LoadBlocker([]string{srv.URL}, nil, "nxdomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordLogger{}
+	addr := servePlugins(t, socket.Options{
+		Upstreams:      []string{"127.0.0.1:1"},
+		Plugins:        []socket.Plugin{blocker.Plugin},
+		Logger:         logger,
+		Reloaders:      []socket.Reloader{blocker},
+		ReloadInterval: 10 * time.Millisecond,
+	})
+
+	srv.set("one.example\ntwo.example\n")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp := exchange(t, addr, newQuery(t, 1, "two.example.", dnsmessage.TypeA)); resp.RCode == dnsmessage.RCodeNameError {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("two.example. was not blocked by a timed reload")
+		}
+	}
+	if !logger.contains("reloaded blocklist of 2 blocking and 0 allowing rules") {
+		t.Errorf("the reload should be logged with the number of rules: %q", logger.lines)
+	}
+}
+
+func TestSocketReload(t *testing.T) {
+	srv := startListServer(t, "one.example\n")
+	blocker, err := socket.LoadBlocker([]string{srv.URL}, nil, "nxdomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := reloaderFunc(func() error { return errors.New("bad list") })
+	logger := &recordLogger{}
+	s, err := socket.New(socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Logger:    logger,
+		Reloaders: []socket.Reloader{failing, blocker},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(s)
+
+	srv.set("one.example\ntwo.example\n")
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "bad list") {
+		t.Errorf("expected the error of the failing reloader, got %v", err)
+	}
+	if !blocker.Blocklist().Blocked("two.example.") {
+		t.Error("the reloaders after a failing one should be reloaded")
+	}
+	if !logger.contains("bad list") || !logger.contains("reloaded blocklist of 2 blocking") {
+		t.Errorf("the reloads should be logged: %q", logger.lines)
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`dns_reloads_total{result="failure"} 1`, `dns_reloads_total{result="success"} 1`} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("metrics should have %s", line)
+		}
+	}
+}
+
+type reloaderFunc func() error
+
+func (f reloaderFunc) Reload() error { return f() }
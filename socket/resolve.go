@@ -0,0 +1,103 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrInvalidName is returned by Resolve for a name that can't be queried.
+var ErrInvalidName = errors.New("socket: invalid name")
+
+// chanWriter hands the response of a query to the goroutine waiting for it.
+type chanWriter struct {
+	resp  chan []byte
+	proto string
+}
+
+func (w *chanWriter) writeMsg(b []byte) error {
+	// the buffer may be reused once the query is done
+	resp := make([]byte, len(b))
+	copy(resp, b)
+	select {
+	case w.resp <- resp:
+	default:
+		return fmt.Errorf("response already written")
+	}
+	return nil
+}
+
+func (w *chanWriter) done() {
+	close(w.resp)
+}
+
+func (w *chanWriter) stream() bool { return true }
+
+func (w *chanWriter) protocol() string { return w.proto }
+
+// resolve queues a query for the workers like the ones read from the udp and
+// tcp listeners, and waits for its response. proto names where it came from
+// in the metrics. It returns false if the query got no response, as it
+// couldn't be parsed or the server is shut down.
+func (s *Socket) resolve(addr net.Addr, query []byte, proto string) ([]byte, bool) {
+	w := &chanWriter{resp: make(chan []byte, 1), proto: proto}
+	req := QueueRequest{
+		Data:   query,
+		Addr:   addr,
+		Length: len(query),
+		w:      w,
+	}
+	// the workers may not be started yet when the socket is not served
+	if !s.serving(0, nil) || !s.enqueue(req) {
+		return nil, false
+	}
+	resp, ok := <-w.resp
+	return resp, ok
+}
+
+// Resolve looks a name up through the cache and the upstreams, like a query
+// sent by a client. checkingDisabled and dnssecOK set the CD and DO bits of
+// the query.
+func (s *Socket) Resolve(name string, qtype dnsmessage.Type, checkingDisabled, dnssecOK bool) (*dnsmessage.Message, error) {
+	if name == "" || name[len(name)-1] != '.' {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidName, name, err)
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	if err := opt.Header.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+			CheckingDisabled: checkingDisabled,
+		},
+		Questions:   []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{opt},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, ok := s.resolve(nil, b, "api")
+	if !ok {
+		return nil, fmt.Errorf("no response for %s", name)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
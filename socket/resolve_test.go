@@ -0,0 +1,34 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolve(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	for i := 0; i < 2; i++ {
+		msg, err := s.Resolve("a.example", dnsmessage.TypeA, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Fatalf("bad response: %+v", msg)
+		}
+		if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{1, 2, 3, 4} {
+			t.Fatalf("bad answer: %v", msg.Answers[0].Body)
+		}
+	}
+	// the second lookup is a cache hit
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1", n)
+	}
+
+	if _, err := s.Resolve("bad..name", dnsmessage.TypeA, false, false); err == nil {
+		t.Error("invalid name resolved")
+	}
+}
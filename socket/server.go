@@ -0,0 +1,266 @@
+package socket
+
+import (
+	"context"
+	"dns-resolver/cache"
+	"errors"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCacheSize is the number of responses cached when no CacheSize
+	// is set
+	defaultCacheSize = 128
+)
+
+// ErrServerClosed is returned by Serve and ServePacket once Shutdown is
+// called.
+var ErrServerClosed = errors.New("socket: server closed")
+
+type (
+	// Options configures a Socket made by New.
+	Options struct {
+		// Upstreams are the dns the queries missing the cache are forwarded
+		// to, each one optionally followed by @weight: host[:port] for plain
+		// dns, tls:// and https:// urls for encrypted dns
+		Upstreams []string
+		// Strategy picks the upstream order, see NewStrategy
+		Strategy string
+		// UpstreamTimeout bounds each attempt, 2s if zero. Failed rounds
+		// over the upstreams are retried Retries times waiting RetryBackoff
+		// (doubled on each retry) in between
+		UpstreamTimeout time.Duration
+		Retries         int
+		RetryBackoff    time.Duration
+		// UpstreamConns is the number of connections kept open to each
+		// upstream, per protocol
+		UpstreamConns int
+		// ForwardRules send the queries for some zones to other upstreams
+		// than Upstreams, with their own timeout and cache policy
+		ForwardRules []ForwardRule
+		// HealthInterval is how often upstreams are probed, zero disables
+		// probing. MaxFails is the number of consecutive failures before an
+		// upstream is marked down
+		HealthInterval time.Duration
+		MaxFails       int
+
+		// CacheSize is the number of responses cached, 128 if zero
+		CacheSize int
+		// MinCacheTTL and MaxCacheTTL clamp the ttl of cached answers,
+		// a zero MaxCacheTTL means no upper limit
+		MinCacheTTL time.Duration
+		MaxCacheTTL time.Duration
+		// MaxNegativeTTL caps how long NXDOMAIN and NODATA answers are cached
+		MaxNegativeTTL time.Duration
+
+		// Workers is the number of queries handled concurrently, and of
+		// goroutines reading each packet conn, the number of cpus if zero
+		Workers int
+		// EDNSSize is the largest udp response sent to EDNS0 clients, 1232
+		// if zero
+		EDNSSize int
+		// TCPIdleTimeout closes the stream connections idle for longer, and
+		// TCPMaxQueries the ones which sent that many queries
+		TCPIdleTimeout time.Duration
+		TCPMaxQueries  int
+
+		// Plugins is the chain of handlers answering the queries, in order:
+		// each one answers a query or hands it to the next. The queries
+		// getting through all of them go to Handler, or get a SERVFAIL if
+		// it's nil. DefaultPlugins is used when both are nil
+		Plugins []Plugin
+		Handler Handler
+		// Logger gets the errors and events, the standard logger if nil
+		Logger Logger
+		// QueryLog gets a record of the queries it samples, none are logged
+		// if nil
+		QueryLog *QueryLog
+		// Dnstap gets the queries of the clients, the ones forwarded to the
+		// upstreams and their responses, if not nil. It's not closed by
+		// Shutdown
+		Dnstap *Dnstap
+		// Reloaders are reloaded by Reload, and each ReloadInterval if it's
+		// not zero
+		Reloaders      []Reloader
+		ReloadInterval time.Duration
+	}
+
+	// Logger receives the errors and events of a Socket, *log.Logger is one.
+	Logger interface {
+		Printf(format string, v ...any)
+		Println(v ...any)
+	}
+)
+
+// New returns a Socket answering the queries read by Serve and ServePacket.
+// Its workers are started by the first of them, Shutdown stops it.
+func New(opts Options) (*Socket, error) {
+	if opts.EDNSSize < minUDPSize {
+		opts.EDNSSize = defaultEDNSSize
+	}
+	if opts.UpstreamTimeout <= 0 {
+		opts.UpstreamTimeout = defaultUpstreamTimeout
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+
+	groups, upstreams, err := newUpstreamGroups(opts)
+	if err != nil {
+		return nil, err
+	}
+	lru, err := cache.NewLRU[cacheKey, *cacheEntry](opts.CacheSize, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Socket{
+		opts:  opts,
+		log:   opts.Logger,
+		cache: lru,
+		bufPoll: sync.Pool{
+			New: func() any {
+				return make([]byte, bufSize)
+			},
+		},
+		upstreams:   upstreams,
+		groups:      groups,
+		queue:       make(Queue, opts.Workers*4),
+		metrics:     newServerMetrics(),
+		ctx:         ctx,
+		cancel:      cancel,
+		packetConns: make(map[net.PacketConn]struct{}),
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+	s.handler = s.chain(opts.Plugins, opts.Handler)
+	return s, nil
+}
+
+// ServePacket answers the queries read from pc, by Workers goroutines, until
+// ctx is done or the socket is shut down. It returns ctx's error or
+// ErrServerClosed, pc is closed by Shutdown but left open when ctx is done.
+func (s *Socket) ServePacket(ctx context.Context, pc net.PacketConn) error {
+	if !s.serving(s.opts.Workers, func() { s.packetConns[pc] = struct{}{} }) {
+		return ErrServerClosed
+	}
+	var (
+		wg      sync.WaitGroup
+		stopped atomic.Bool
+	)
+	for i := 0; i < s.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.reader(pc, &stopped)
+		}()
+	}
+
+	select {
+	case <-s.done:
+		wg.Wait()
+		return ErrServerClosed
+	case <-ctx.Done():
+	}
+	// readers check stopped when interrupted
+	stopped.Store(true)
+	if err := pc.SetReadDeadline(time.Now()); err != nil {
+		s.log.Println(err)
+	}
+	wg.Wait()
+	s.mu.Lock()
+	delete(s.packetConns, pc)
+	s.mu.Unlock()
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		s.log.Println(err)
+	}
+	return ctx.Err()
+}
+
+// Serve answers the queries of the stream connections accepted from l, dns
+// over tcp or over tls, until ctx is done or the socket is shut down. l is
+// closed when it returns, with ctx's error or ErrServerClosed; the
+// connections already accepted are served until they are closed.
+func (s *Socket) Serve(ctx context.Context, l net.Listener) error {
+	if !s.serving(1, func() { s.listeners[l] = struct{}{} }) {
+		return ErrServerClosed
+	}
+	done := make(chan struct{})
+	go func() {
+		s.accepter(l)
+		close(done)
+	}()
+
+	select {
+	case <-s.done:
+		<-done
+		return ErrServerClosed
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+	s.closeListener(l)
+	<-done
+	return ctx.Err()
+}
+
+// serving registers new readers of queries, along with what they
+// read from, and starts the workers the first time. It returns false once
+// the socket is shut down.
+func (s *Socket) serving(readers int, register func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	s.startOnce.Do(func() {
+		for i := 0; i < s.opts.Workers; i++ {
+			s.workers.Add(1)
+			go s.dequeuer()
+		}
+		if s.opts.HealthInterval > 0 {
+			go s.healthChecker()
+		}
+		if s.opts.ReloadInterval > 0 && len(s.opts.Reloaders) > 0 {
+			go s.reloader()
+		}
+	})
+	s.readers.Add(readers)
+	if register != nil {
+		register()
+	}
+	return true
+}
+
+// logWriter adapts a Logger to the *log.Logger some packages want.
+type logWriter struct {
+	log Logger
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.log.Println(strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+// stdLogger returns l as a *log.Logger.
+func stdLogger(l Logger) *log.Logger {
+	if std, ok := l.(*log.Logger); ok {
+		return std
+	}
+	return log.New(logWriter{l}, "", 0)
+}
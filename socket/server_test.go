@@ -0,0 +1,178 @@
+package socket_test
+
+import (
+	"context"
+	"dns-resolver/socket"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recordLogger keeps the lines logged by a socket.
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Println(v ...any) {
+	l.Printf("%s", fmt.Sprintln(v...))
+}
+
+func (l *recordLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServe(t *testing.T) {
+	u := startUpstream(t, nil)
+	logger := &recordLogger{}
+	s, err := socket.New(socket.Options{
+		Upstreams: []string{u.addr},
+		Workers:   2,
+		Logger:    logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(s) })
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	packetDone := make(chan error, 1)
+	streamDone := make(chan error, 1)
+	go func() { packetDone <- s.ServePacket(ctx, pc) }()
+	go func() { streamDone <- s.Serve(ctx, l) }()
+
+	resp := exchange(t, pc.LocalAddr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if len(resp.Answers) != 1 {
+		t.Fatalf("bad udp response: %+v", resp)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeMsg(conn, newQuery(t, 2, "b.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMsg(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// the errors go to the logger
+	if _, err := pc.WriteTo([]byte{1, 2, 3}, pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !logger.contains("insufficient data"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("error not logged: %q", logger.lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	for _, done := range []chan error{packetDone, streamDone} {
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("serve should return the context error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("serve did not return")
+		}
+	}
+	// the packet conn is left to its owner, the listener is closed
+	if _, err := pc.WriteTo([]byte{0}, pc.LocalAddr()); err != nil {
+		t.Errorf("packet conn should still be open: %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("listener should be closed, got %v", err)
+	}
+
+	shutdown(s)
+	if err := s.ServePacket(context.Background(), pc); !errors.Is(err, socket.ErrServerClosed) {
+		t.Errorf("serve after shutdown should fail, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	remote := make(chan net.Addr, 1)
+	s, err := socket.New(socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Handler: socket.HandlerFunc(func(ctx context.Context, w socket.ResponseWriter, r *dnsmessage.Message) {
+			remote <- w.RemoteAddr()
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: r.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+				Questions: r.Questions,
+			}
+			if err := w.WriteMsg(&resp); err != nil {
+				t.Error(err)
+			}
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(s) })
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(context.Background(), pc)
+
+	resp := exchange(t, pc.LocalAddr().String(), newQuery(t, 7, "custom.example.", dnsmessage.TypeA))
+	if resp.ID != 7 || resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("bad response: %+v", resp)
+	}
+	if addr := <-remote; addr == nil {
+		t.Error("handler should know the client address")
+	}
+}
+
+func TestHandlerShortWrite(t *testing.T) {
+	addr := servePlugins(t, socket.Options{
+		Upstreams: []string{"127.0.0.1:1"},
+		Handler: socket.HandlerFunc(func(ctx context.Context, w socket.ResponseWriter, r *dnsmessage.Message) {
+			if _, err := w.Write([]byte{0, 1}); err == nil {
+				t.Error("a message shorter than a header should not be written")
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: r.ID, Response: true},
+				Questions: r.Questions,
+			}
+			if err := w.WriteMsg(&resp); err != nil {
+				t.Error(err)
+			}
+		}),
+	})
+	if resp := exchange(t, addr, newQuery(t, 7, "short.example.", dnsmessage.TypeA)); resp.ID != 7 {
+		t.Errorf("bad response: %+v", resp)
+	}
+}
@@ -0,0 +1,142 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shutdown stops the server gracefully: it stops reading new queries, waits
+// for the ones already read to be answered, then closes the listeners, the
+// packet conns and the upstream connections. If ctx is done first, the
+// queries still waiting on an upstream fail, the client connections are
+// closed and ctx's error is returned.
+func (s *Socket) Shutdown(ctx context.Context) error {
+	if s.closing.Swap(true) {
+		return fmt.Errorf("socket already shut down")
+	}
+	close(s.done)
+
+	s.mu.Lock()
+	// the packet conns are only interrupted, the queries already read are
+	// answered over them
+	for pc := range s.packetConns {
+		if err := pc.SetReadDeadline(time.Now()); err != nil {
+			s.log.Println(err)
+		}
+	}
+	for l := range s.listeners {
+		s.closeListener(l)
+	}
+	for conn := range s.conns {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			s.log.Println(err)
+		}
+	}
+	s.mu.Unlock()
+
+	var err error
+	if s.httpServer != nil {
+		// it waits for the queries of its handlers, the workers are still
+		// running meanwhile
+		if err = s.httpServer.Shutdown(ctx); err != nil {
+			s.httpServer.Close()
+		}
+		s.closeListener(s.httpListen)
+	}
+	if err == nil {
+		err = wait(ctx, &s.readers)
+	}
+	if err != nil {
+		s.cancel()
+		s.closeUpstreams()
+		s.closeConns()
+	}
+
+	s.queueMu.Lock()
+	s.queueClosed = true
+	close(s.queue)
+	s.queueMu.Unlock()
+	if err == nil {
+		err = wait(ctx, &s.workers)
+	}
+
+	s.cancel()
+	s.closeUpstreams()
+	s.closeConns()
+	s.mu.Lock()
+	for pc := range s.packetConns {
+		s.closeListener(pc)
+	}
+	s.mu.Unlock()
+	// the listeners opened by NewSocket may not be served yet
+	if s.listener != nil {
+		s.closeListener(s.listener)
+	}
+	if s.tcpListener != nil {
+		s.closeListener(s.tcpListener)
+	}
+	if s.tlsListener != nil {
+		s.closeListener(s.tlsListener)
+	}
+	// the metrics are served until the end, they tell how the queries drain
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.metricsListen != nil {
+		s.closeListener(s.metricsListen)
+	}
+	if s.queryLogWriter != nil {
+		s.closeListener(s.queryLogWriter)
+	}
+	if s.dnstap != nil {
+		s.closeListener(s.dnstap)
+	}
+	return err
+}
+
+// closeUpstreams closes the connections kept open to the upstreams.
+func (s *Socket) closeUpstreams() {
+	for _, u := range s.upstreams {
+		u.udp.close()
+		if u.tcp != u.udp {
+			u.tcp.close()
+		}
+	}
+}
+
+// closeConns closes the client stream connections still open.
+func (s *Socket) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.log.Println(err)
+		}
+	}
+}
+
+func (s *Socket) closeListener(l io.Closer) {
+	if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.log.Println(err)
+	}
+}
+
+// wait waits for wg, up to ctx being done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
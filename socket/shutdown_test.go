@@ -0,0 +1,138 @@
+package socket_test
+
+import (
+	"context"
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// shutdown stops a socket at the end of a test, the tests already shutting it
+// down get an error ignored here.
+func shutdown(s *socket.Socket) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+// waitQueries waits for u to get n queries.
+func waitQueries(t *testing.T, u *fakeUpstream, n int32) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); u.queries.Load() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream got %d queries, want %d", u.queries.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	answer := answerA([4]byte{1, 2, 3, 4}, 300)
+	u := startUpstream(t, func(q dnsmessage.Message) dnsmessage.Message {
+		time.Sleep(300 * time.Millisecond)
+		return answer(q)
+	})
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:         u.addr,
+		UpstreamTimeout: 5 * time.Second,
+		TCP:             true,
+		TCPIdleTimeout:  5 * time.Second,
+	})
+
+	udp, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp.SetDeadline(time.Now().Add(5 * time.Second))
+	tcp.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := udp.Write(newQuery(t, 1, "udp.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMsg(tcp, newQuery(t, 2, "tcp.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	waitQueries(t, u, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the queries read before the shutdown are answered
+	buf := make([]byte, 512)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil || resp.ID != 1 || len(resp.Answers) != 1 {
+		t.Errorf("bad udp response: %+v, %v", resp, err)
+	}
+	b, err := readMsg(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Unpack(b); err != nil || resp.ID != 2 || len(resp.Answers) != 1 {
+		t.Errorf("bad tcp response: %+v, %v", resp, err)
+	}
+	if _, err := readMsg(tcp); err == nil {
+		t.Error("tcp connection should be closed")
+	}
+
+	// and no new one is
+	if _, err := net.DialTimeout("tcp", s.Addr().String(), time.Second); err == nil {
+		t.Error("tcp listener should be closed")
+	}
+	if _, err := udp.Write(newQuery(t, 3, "late.example.", dnsmessage.TypeA)); err == nil {
+		udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := udp.Read(buf); err == nil {
+			t.Error("query answered after shutdown")
+		}
+	}
+
+	if err := s.Shutdown(ctx); err == nil {
+		t.Error("second shutdown should fail")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	u := startUpstream(t, nil)
+	u.drop.Store(100)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:         u.addr,
+		UpstreamTimeout: 5 * time.Second,
+	})
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(newQuery(t, 1, "a.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	waitQueries(t, u, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown should have timed out, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+}
@@ -1,25 +1,76 @@
 package socket
 
 import (
+	"context"
 	"dns-resolver/args"
 	"dns-resolver/cache"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
 type (
+	// Socket is a forwarding dns server: the queries read by its listeners
+	// are queued for its workers, which answer them with its Handler.
 	Socket struct {
-		args     args.SocketArgs
-		mu       sync.Mutex
-		cache    *cache.LRU[dnsmessage.Question, []dnsmessage.Resource]
-		bufPoll  sync.Pool
-		connPoll sync.Pool
-		listener *net.UDPConn
-		queue    Queue
+		opts      Options
+		log       Logger
+		handler   Handler
+		mu        sync.Mutex
+		cache     *cache.LRU[cacheKey, *cacheEntry]
+		bufPoll   sync.Pool
+		upstreams []*Upstream
+		groups    map[string]*upstreamGroup
+		flights   flightGroup
+		queue     Queue
+		metrics   *serverMetrics
+		// activeWorkers is the number of workers handling a query
+		activeWorkers atomic.Int64
+		// ctx is the context of the queries, cancelled by Shutdown
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		// the listeners opened by NewSocket
+		listener    *net.UDPConn
+		tcpListener *net.TCPListener
+		tlsListener net.Listener
+		httpServer  *http.Server
+		httpMux     *http.ServeMux
+		httpListen  net.Listener
+		// metricsServer serves MetricsHandler on metricsListen
+		metricsServer *http.Server
+		metricsListen net.Listener
+		// queryLogWriter is the destination of the query log, dnstap the one
+		// of the dnstap messages
+		queryLogWriter io.Closer
+		dnstap         *Dnstap
+		certFile       string
+		keyFile        string
+
+		// closing is set once Shutdown is called, queueClosed once the
+		// queue is closed, queueMu guards sending to the queue against it
+		closing     atomic.Bool
+		queueMu     sync.RWMutex
+		queueClosed bool
+		startOnce   sync.Once
+		// readers are the goroutines reading queries, workers the ones
+		// handling them
+		readers sync.WaitGroup
+		workers sync.WaitGroup
+		// packetConns and listeners are the ones served, conns the open
+		// stream connections, all guarded by mu
+		packetConns map[net.PacketConn]struct{}
+		listeners   map[net.Listener]struct{}
+		conns       map[net.Conn]struct{}
+		done        chan struct{}
 	}
 	Queue chan QueueRequest
 
@@ -27,187 +78,407 @@ type (
 		Data   []byte
 		Addr   net.Addr
 		Length int
+		w      responseWriter
+	}
+
+	// responseWriter sends the response of a query back to the client it came from
+	responseWriter interface {
+		writeMsg(b []byte) error
+		// done is called once the query is handled, whether a response was written or not
+		done()
+		// stream reports whether the client transport carries responses of any
+		// size, as opposed to udp
+		stream() bool
+		// protocol names the client transport in the metrics
+		protocol() string
+	}
+
+	udpWriter struct {
+		conn net.PacketConn
+		addr net.Addr
 	}
 )
 
+// bufSize is the size of the buffers kept in bufPoll, large enough for any
+// query a client sends over udp
+const bufSize = 4096
+
+func (w udpWriter) writeMsg(b []byte) error {
+	_, err := w.conn.WriteTo(b, w.addr)
+	return err
+}
+
+func (w udpWriter) done() {}
+
+func (w udpWriter) stream() bool { return false }
+
+func (w udpWriter) protocol() string { return "udp" }
+
+// NewSocket returns a Socket configured by the command line arguments, its
+// listeners are opened but served by ListenAndServe only.
 func NewSocket(args args.SocketArgs) (*Socket, error) {
 	var (
-		listen *net.UDPConn
-		err    error
+		listen        *net.UDPConn
+		tcpListen     *net.TCPListener
+		tlsListen     net.Listener
+		httpListen    net.Listener
+		metricsListen net.Listener
+		forwardRules  []ForwardRule
+		authority     *Authority
+		blocker       *Blocker
+		plugins       []Plugin
+		reloaders     []Reloader
+		err           error
 	)
 
-	localAddr, err := net.ResolveUDPAddr(args.Network, args.Addr)
+	for _, spec := range args.ForwardRules {
+		rule, err := ParseForwardRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		forwardRules = append(forwardRules, rule)
+	}
+	if args.Hosts != "" || args.Zones != "" {
+		if authority, err = LoadAuthority(splitList(args.Hosts), splitList(args.Zones)); err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, authority.Plugin)
+		reloaders = append(reloaders, authority)
+	}
+	if args.Blocklists != "" {
+		if blocker, err = newBlockerFromArgs(args); err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, blocker.Plugin)
+		reloaders = append(reloaders, blocker)
+	}
+	if plugins != nil {
+		plugins = append(plugins, DefaultPlugins()...)
+	}
+
+	s, err := New(Options{
+		Upstreams:       strings.Split(args.DNSAddr, ","),
+		Strategy:        args.Strategy,
+		ForwardRules:    forwardRules,
+		UpstreamTimeout: args.UpstreamTimeout,
+		Retries:         args.Retries,
+		RetryBackoff:    args.RetryBackoff,
+		UpstreamConns:   args.UpstreamConns,
+		HealthInterval:  args.HealthInterval,
+		MaxFails:        args.MaxFails,
+		CacheSize:       args.CacheSize,
+		MinCacheTTL:     args.MinCacheTTL,
+		MaxCacheTTL:     args.MaxCacheTTL,
+		MaxNegativeTTL:  args.MaxNegativeTTL,
+		Workers:         args.Workers,
+		EDNSSize:        args.EDNSSize,
+		TCPIdleTimeout:  args.TCPIdleTimeout,
+		TCPMaxQueries:   args.TCPMaxQueries,
+		Plugins:         plugins,
+		Reloaders:       reloaders,
+		ReloadInterval:  args.ReloadInterval,
+	})
 	if err != nil {
 		return nil, err
 	}
+	if authority != nil {
+		s.log.Printf("loaded %s\n", authority)
+	}
+	if blocker != nil {
+		s.log.Printf("loaded %s\n", blocker)
+	}
 
-	if args.Network == "udp" {
-		listen, err = net.ListenUDP(args.Network, localAddr)
-	} else {
-		return nil, fmt.Errorf("network not supported")
-
+	// tcp is served along with udp, on the same address
+	if args.Network != "udp" {
+		return nil, fmt.Errorf("network %q not supported: queries are served over udp, and over tcp as well with -tcp", args.Network)
 	}
+	localAddr, err := net.ResolveUDPAddr(args.Network, args.Addr)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("started listening on: %s\n", args.Addr)
+	listen, err = net.ListenUDP(args.Network, localAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Printf("started listening on: %s\n", args.Addr)
+	// the listeners already opened are closed if a next one fails
+	opened := []io.Closer{listen}
+	started := false
+	defer func() {
+		if !started {
+			for _, l := range opened {
+				s.closeListener(l)
+			}
+		}
+	}()
 
-	onEvict := func(_ dnsmessage.Question, _ []dnsmessage.Resource) {
+	if args.TCP {
+		// use the port the udp listener got, in case addr asked for any port
+		tcpAddr, err := net.ResolveTCPAddr("tcp", listen.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		tcpListen, err = net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, tcpListen)
+		s.log.Printf("started listening on: %s (tcp)\n", args.Addr)
 	}
 
-	lru, err := cache.NewLRU(args.CacheSize, onEvict)
-	if err != nil {
-		return nil, err
+	if args.DoTAddr != "" {
+		tlsListen, err = listenTLS(args.DoTAddr, args.CertFile, args.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, tlsListen)
+		s.log.Printf("started listening on: %s (tls)\n", args.DoTAddr)
 	}
 
-	return &Socket{
-		args:  args,
-		mu:    sync.Mutex{},
-		cache: lru,
-		bufPoll: sync.Pool{
-			New: func() any {
-				return make([]byte, 512)
-			},
-		},
-		connPoll: sync.Pool{
-			New: func() any {
-				c, err := net.Dial(args.Network, args.DNSAddr)
-				if err != nil {
-					log.Println(err)
-					return nil
-				}
-				return c
-			},
-		},
-		listener: listen,
-		queue:    make(Queue, args.Workers*4),
-	}, nil
-}
+	if args.DoHAddr != "" {
+		httpListen, err = net.Listen("tcp", args.DoHAddr)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, httpListen)
+		if args.CertFile == "" {
+			s.log.Printf("started listening on: %s (http, no certificate given so no http/2 nor tls)\n", args.DoHAddr)
+		} else {
+			s.log.Printf("started listening on: %s (https)\n", args.DoHAddr)
+		}
+	}
 
-// ListenAndServe is a non blocking call,
-func (s *Socket) ListenAndServe() {
-	for i := 0; i < s.args.Workers; i++ {
-		go s.dequeuer()
-		go s.reader()
+	if args.MetricsAddr != "" {
+		metricsListen, err = net.Listen("tcp", args.MetricsAddr)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, metricsListen)
+		s.log.Printf("started listening on: %s (metrics)\n", args.MetricsAddr)
 	}
-}
 
-func (s *Socket) reader() {
-	for {
-		buf := s.bufPoll.Get().([]byte)
-		n, addr, err := s.listener.ReadFromUDP(buf[0:])
+	if args.QueryLog != "" {
+		w, err := OpenQueryLog(args.QueryLog, int64(args.QueryLogMaxSize)<<20, args.QueryLogBackups)
 		if err != nil {
-			log.Println(err)
-			continue
+			return nil, err
 		}
+		opened = append(opened, w)
+		s.queryLogWriter = w
+		s.opts.QueryLog = NewQueryLog(w, args.QueryLogSample)
+	}
 
-		s.queue <- QueueRequest{
-			Data:   buf,
-			Addr:   addr,
-			Length: n,
+	if args.Dnstap != "" {
+		identity, _ := os.Hostname()
+		tap, err := OpenDnstap(args.Dnstap, DnstapOptions{
+			Identity: identity,
+			Version:  "dns-resolver",
+			Wire:     args.DnstapWire,
+			Logger:   s.log,
+		})
+		if err != nil {
+			return nil, err
 		}
+		opened = append(opened, tap)
+		s.dnstap = tap
+		s.opts.Dnstap = tap
 	}
-}
 
-// suggest a better name for this
-func (s *Socket) dequeuer() {
-	for req := range s.queue {
-		s.udpHandler(req.Addr, req.Data[:req.Length])
-        	s.bufPoll.Put(req.Data)
+	s.listener = listen
+	s.tcpListener = tcpListen
+	s.tlsListener = tlsListen
+	s.httpListen = httpListen
+	s.certFile = args.CertFile
+	s.keyFile = args.KeyFile
+	if httpListen != nil {
+		s.httpServer = s.newHTTPServer()
+	}
+	s.metricsListen = metricsListen
+	if metricsListen != nil {
+		mux := http.NewServeMux()
+		mux.Handle(metricsPath, s.MetricsHandler())
+		s.metricsServer = &http.Server{
+			Handler:      mux,
+			ReadTimeout:  httpTimeout,
+			WriteTimeout: httpTimeout,
+			ErrorLog:     stdLogger(s.log),
+		}
 	}
+	started = true
+	return s, nil
 }
 
-func (s *Socket) udpHandler(addr net.Addr, in []byte) {
-	parser := dnsmessage.Parser{}
+// newBlockerFromArgs loads the block and allow lists of the command line.
+func newBlockerFromArgs(args args.SocketArgs) (*Blocker, error) {
+	return LoadBlocker(splitList(args.Blocklists), splitList(args.Allowlists), args.BlockAnswer)
+}
 
-	header, err := parser.Start(in)
-	if err != nil {
-		log.Println(err)
-		return
+// splitList splits a comma separated list of the command line, nil if empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
+	return strings.Split(s, ",")
+}
 
-	question, err := parser.AllQuestions()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	//get result from cache
-	if answer, ok := s.cache.Get(question[0]); ok {
-		responseByte := s.bufPoll.Get().([]byte)
-		msg := dnsmessage.Message{
-			Header: dnsmessage.Header{
-				ID:       header.ID,
-				Response: true,
-				RCode:    dnsmessage.RCodeSuccess,
-			},
-			Questions: question,
-			Answers:   answer,
-		}
-		responseByte, err = msg.Pack()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_, err = s.listener.WriteTo(responseByte, addr)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-	} else {
-		//parser2 := dnsmessage.Parser{}
-		remoteDns, ok := s.connPoll.Get().(net.Conn)
-		defer func() {
-			err := remoteDns.Close()
-			if err != nil {
-				log.Println(err)
+// ListenAndServe serves the listeners opened by NewSocket, it is a non
+// blocking call, Shutdown stops the server.
+func (s *Socket) ListenAndServe() {
+	ctx := context.Background()
+	s.serve(func() error { return s.ServePacket(ctx, s.listener) })
+	if s.tcpListener != nil {
+		s.serve(func() error { return s.Serve(ctx, s.tcpListener) })
+	}
+	if s.tlsListener != nil {
+		s.serve(func() error { return s.Serve(ctx, s.tlsListener) })
+	}
+	if s.httpServer != nil {
+		go s.serveHTTP(s.httpServer, s.httpListen)
+	}
+	if s.metricsServer != nil {
+		go func() {
+			if err := s.metricsServer.Serve(s.metricsListen); !errors.Is(err, http.ErrServerClosed) {
+				s.log.Println(err)
 			}
 		}()
-		if !ok {
-			log.Println("cant connect to remote dns")
-			return
-		}
-		// redirect the query to remoteDns
-		_, err := remoteDns.Write(in)
-		if err != nil {
-			log.Println(err)
-			return
+	}
+}
+
+// serve runs a Serve or ServePacket call in the background.
+func (s *Socket) serve(serve func() error) {
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, ErrServerClosed) {
+			s.log.Println(err)
 		}
+	}()
+}
 
-		resp := s.bufPoll.Get().([]byte)
+// Addr returns the address the udp (and tcp) listener is bound to.
+func (s *Socket) Addr() net.Addr {
+	return s.listener.LocalAddr()
+}
 
-		// read response from remoteDns
-		n, err := remoteDns.Read(resp[0:])
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		// write response to user
-		_, err = s.listener.WriteTo(resp[:n], addr)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+// TLSAddr returns the address the dns over tls listener is bound to, nil if
+// there is none.
+func (s *Socket) TLSAddr() net.Addr {
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+// HTTPAddr returns the address the dns over https listener is bound to, nil
+// if there is none.
+func (s *Socket) HTTPAddr() net.Addr {
+	if s.httpListen == nil {
+		return nil
+	}
+	return s.httpListen.Addr()
+}
 
-		// start parsing response to add it to the cache
-		_, err = parser.Start(resp)
+// MetricsAddr returns the address the metrics listener is bound to, nil if
+// there is none.
+func (s *Socket) MetricsAddr() net.Addr {
+	if s.metricsListen == nil {
+		return nil
+	}
+	return s.metricsListen.Addr()
+}
+
+// getBuf returns a buffer of length n, taken from bufPoll when it fits.
+func (s *Socket) getBuf(n int) []byte {
+	if n <= bufSize {
+		return s.bufPoll.Get().([]byte)[:n]
+	}
+	return make([]byte, n)
+}
+
+// putBuf gives a buffer back to bufPoll, buffers not made by it are dropped.
+func (s *Socket) putBuf(b []byte) {
+	if cap(b) == bufSize {
+		s.bufPoll.Put(b[:bufSize])
+	}
+}
+
+// reader queues the queries read from pc until it's interrupted by Shutdown
+// or once stopped is set.
+func (s *Socket) reader(pc net.PacketConn, stopped *atomic.Bool) {
+	defer s.readers.Done()
+	for {
+		buf := s.bufPoll.Get().([]byte)
+		n, addr, err := pc.ReadFrom(buf[0:])
 		if err != nil {
-			log.Println(err)
-			return
+			s.putBuf(buf)
+			if s.closing.Load() || stopped.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.log.Println(err)
+			continue
 		}
 
-		question, err := parser.AllQuestions()
-		if err != nil {
-			log.Println(err)
-			return
+		req := QueueRequest{
+			Data:   buf,
+			Addr:   addr,
+			Length: n,
+			w:      udpWriter{conn: pc, addr: addr},
 		}
-		r, err := parser.AllAnswers()
-		if err != nil {
-			log.Println(err)
+		if !s.enqueue(req) {
+			s.putBuf(buf)
 			return
 		}
+	}
+}
 
-		if r != nil {
-			s.cache.Add(question[0], r)
-		}
+// enqueue queues a query for the workers, it returns false once the queue
+// is closed by Shutdown.
+func (s *Socket) enqueue(req QueueRequest) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queueClosed {
+		return false
+	}
+	s.queue <- req
+	return true
+}
+
+// errorResponse returns an empty response to a query with the given rcode.
+func errorResponse(query dnsmessage.Header, question []dnsmessage.Question, edns clientEDNS, rcode dnsmessage.RCode, ednsSize int) dnsmessage.Message {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			CheckingDisabled:   query.CheckingDisabled,
+		},
+		Questions: question,
+	}
+	setRCode(&msg, rcode)
+	if edns.opt != nil {
+		msg.Additionals = []dnsmessage.Resource{ednsReply(nil, rcode, ednsSize, edns.dnssecOK)}
+	}
+	return msg
+}
+
+// WriteError answers a query with an empty response with the given rcode,
+// along with an OPT record if the query has one.
+func (s *Socket) WriteError(w ResponseWriter, query *dnsmessage.Message, rcode dnsmessage.RCode) {
+	_, opt := splitOPT(query.Additionals)
+	edns := newClientEDNS(opt, w.Stream(), s.opts.EDNSSize)
+	msg := errorResponse(query.Header, query.Questions, edns, rcode, s.opts.EDNSSize)
+	if err := w.WriteMsg(&msg); err != nil {
+		s.log.Println(err)
+	}
+}
+
+// suggest a better name for this
+func (s *Socket) dequeuer() {
+	defer s.workers.Done()
+	for req := range s.queue {
+		s.activeWorkers.Add(1)
+		s.serveQuery(req)
+		s.activeWorkers.Add(-1)
+		req.w.done()
+		s.putBuf(req.Data)
 	}
 }
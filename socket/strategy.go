@@ -0,0 +1,126 @@
+package socket
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy decides which upstreams a query is forwarded to, and in which
+// order they are tried on failure.
+type Strategy interface {
+	// Select returns the upstreams in the order they should be tried in.
+	// It must not modify upstreams.
+	Select(upstreams []*Upstream) []*Upstream
+}
+
+type (
+	// Sequential tries the upstreams in the order they were given.
+	Sequential struct{}
+
+	// RoundRobin starts with the next upstream on each query.
+	RoundRobin struct {
+		next atomic.Uint32
+	}
+
+	// Random picks the upstreams at random, proportionally to their weight.
+	Random struct {
+		mu  sync.Mutex
+		rnd *rand.Rand
+	}
+
+	// Fastest tries the upstreams with the lowest round trip time first.
+	Fastest struct{}
+)
+
+// NewStrategy returns the strategy with the given name, one of sequential,
+// roundrobin, random or fastest.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", "sequential":
+		return Sequential{}, nil
+	case "roundrobin":
+		return &RoundRobin{}, nil
+	case "random":
+		return NewRandom(rand.Int63()), nil
+	case "fastest":
+		return Fastest{}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", name)
+	}
+}
+
+// NewRandom returns a Random strategy seeded with seed.
+func NewRandom(seed int64) *Random {
+	return &Random{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (Sequential) Select(upstreams []*Upstream) []*Upstream {
+	return healthyFirst(upstreams)
+}
+
+func (r *RoundRobin) Select(upstreams []*Upstream) []*Upstream {
+	n := len(upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int((r.next.Add(1) - 1) % uint32(n))
+	rotated := make([]*Upstream, 0, n)
+	rotated = append(rotated, upstreams[start:]...)
+	rotated = append(rotated, upstreams[:start]...)
+	return healthyFirst(rotated)
+}
+
+func (r *Random) Select(upstreams []*Upstream) []*Upstream {
+	left := make([]*Upstream, len(upstreams))
+	copy(left, upstreams)
+	total := 0
+	for _, u := range left {
+		total += u.weight
+	}
+
+	// weighted sampling without replacement
+	picked := make([]*Upstream, 0, len(upstreams))
+	r.mu.Lock()
+	for len(left) > 0 {
+		n := r.rnd.Intn(total)
+		i := 0
+		for ; n >= left[i].weight; i++ {
+			n -= left[i].weight
+		}
+		picked = append(picked, left[i])
+		total -= left[i].weight
+		left = append(left[:i], left[i+1:]...)
+	}
+	r.mu.Unlock()
+	return healthyFirst(picked)
+}
+
+func (Fastest) Select(upstreams []*Upstream) []*Upstream {
+	sorted := make([]*Upstream, len(upstreams))
+	copy(sorted, upstreams)
+	// upstreams never measured have a zero rtt, so they get tried early
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RTT() < sorted[j].RTT()
+	})
+	return healthyFirst(sorted)
+}
+
+// healthyFirst moves the upstreams that are down behind the healthy ones,
+// keeping their order otherwise.
+func healthyFirst(upstreams []*Upstream) []*Upstream {
+	order := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.Healthy() {
+			order = append(order, u)
+		}
+	}
+	for _, u := range upstreams {
+		if !u.Healthy() {
+			order = append(order, u)
+		}
+	}
+	return order
+}
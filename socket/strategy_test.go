@@ -0,0 +1,120 @@
+package socket
+
+import (
+	"log"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUpstreams(t *testing.T, list string) []*Upstream {
+	t.Helper()
+	us, err := parseUpstreams(strings.Split(list, ","), time.Second, 1, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return us
+}
+
+func addrs(us []*Upstream) []string {
+	as := make([]string, len(us))
+	for i, u := range us {
+		as[i] = u.Addr()
+	}
+	return as
+}
+
+func TestParseUpstreams(t *testing.T) {
+	us := testUpstreams(t, "1.1.1.1, 8.8.8.8:5353@3,[::1]:53")
+	want := []string{"1.1.1.1:53", "8.8.8.8:5353", "[::1]:53"}
+	for i, u := range us {
+		if u.Addr() != want[i] {
+			t.Errorf("bad addr: %s != %s", u.Addr(), want[i])
+		}
+	}
+	if us[0].Weight() != 1 || us[1].Weight() != 3 {
+		t.Errorf("bad weights: %d, %d", us[0].Weight(), us[1].Weight())
+	}
+
+	pin := "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	us = testUpstreams(t, "tls://1.1.1.1?sni=one.one.one.one@2,https://dns.example/dns-query?pin="+pin+"&ct=1")
+	want = []string{"tls://1.1.1.1:853", "https://dns.example/dns-query?ct=1"}
+	for i, u := range us {
+		if u.Addr() != want[i] {
+			t.Errorf("bad addr: %s != %s", u.Addr(), want[i])
+		}
+		if u.udp != u.tcp {
+			t.Errorf("%s: udp and tcp queries should share their connections", u.Addr())
+		}
+	}
+	if us[0].Weight() != 2 {
+		t.Errorf("bad weight: %d", us[0].Weight())
+	}
+
+	for _, list := range []string{"", "1.1.1.1@0", "1.1.1.1@x", "tls://", "tls://1.1.1.1/path", "https://dns.example/?pin=short", "quic://dns.example"} {
+		if _, err := parseUpstreams(strings.Split(list, ","), time.Second, 1, log.Default()); err == nil {
+			t.Errorf("%q should not parse", list)
+		}
+	}
+}
+
+func TestSequential(t *testing.T) {
+	us := testUpstreams(t, "a,b,c")
+	us[0].healthy.Store(false)
+	got := addrs(Sequential{}.Select(us))
+	if got[0] != "b:53" || got[1] != "c:53" || got[2] != "a:53" {
+		t.Errorf("down upstreams should be tried last: %v", got)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	us := testUpstreams(t, "a,b,c")
+	r := &RoundRobin{}
+	for i := 0; i < 6; i++ {
+		if got := r.Select(us)[0]; got != us[i%3] {
+			t.Errorf("query %d went to %s", i, got.Addr())
+		}
+	}
+
+	// the counter wraps around without going negative
+	r.next.Store(math.MaxUint32)
+	if got := r.Select(us)[0]; got != us[math.MaxUint32%3] {
+		t.Errorf("query at the counter end went to %s", got.Addr())
+	}
+	if got := r.Select(us)[0]; got != us[0] {
+		t.Errorf("query after the wrap around went to %s", got.Addr())
+	}
+}
+
+func TestRandom(t *testing.T) {
+	us := testUpstreams(t, "a@1,b@9")
+	r := NewRandom(1)
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		order := r.Select(us)
+		if len(order) != 2 {
+			t.Fatalf("every upstream should be selected: %v", addrs(order))
+		}
+		first[order[0].Addr()]++
+	}
+	if first["b:53"] < 800 || first["a:53"] < 50 {
+		t.Errorf("selection doesn't follow the weights: %v", first)
+	}
+}
+
+func TestFastest(t *testing.T) {
+	us := testUpstreams(t, "a,b,c")
+	us[0].observeRTT(30 * time.Millisecond)
+	us[1].observeRTT(10 * time.Millisecond)
+	us[2].observeRTT(20 * time.Millisecond)
+	if got := addrs(Fastest{}.Select(us)); got[0] != "b:53" || got[1] != "c:53" || got[2] != "a:53" {
+		t.Errorf("bad order: %v", got)
+	}
+
+	// a single slow exchange shouldn't outweigh the history
+	us[1].observeRTT(40 * time.Millisecond)
+	if rtt := us[1].RTT(); rtt != 19*time.Millisecond {
+		t.Errorf("bad moving average: %v", rtt)
+	}
+}
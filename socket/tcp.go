@@ -0,0 +1,168 @@
+package socket
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpWriteTimeout bounds how long a worker may block writing to a slow tcp client
+	tcpWriteTimeout = 5 * time.Second
+	// acceptMinDelay and acceptMaxDelay bound the wait after a failed accept,
+	// doubled on each failure in a row
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// tcpConn is a client connection speaking dns over tcp (RFC 7766).
+// Queries are pipelined: each one is queued as soon as it's read and the
+// responses are written back in whatever order the workers finish them.
+type tcpConn struct {
+	conn    net.Conn
+	proto   string
+	mu      sync.Mutex
+	pending sync.WaitGroup
+}
+
+func (c *tcpConn) writeMsg(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout)); err != nil {
+		return err
+	}
+	return writeTCPMsg(c.conn, b)
+}
+
+func (c *tcpConn) done() {
+	c.pending.Done()
+}
+
+func (c *tcpConn) stream() bool { return true }
+
+func (c *tcpConn) protocol() string { return c.proto }
+
+// accepter serves the connections of a tcp or tls listener until it's closed.
+// It backs off on accept errors, like running out of file descriptors.
+func (s *Socket) accepter(l net.Listener) {
+	defer s.readers.Done()
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay *= 2; delay == 0 {
+				delay = acceptMinDelay
+			} else if delay > acceptMaxDelay {
+				delay = acceptMaxDelay
+			}
+			s.log.Printf("%v, retrying in %v\n", err, delay)
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-s.done:
+				t.Stop()
+			}
+			continue
+		}
+		delay = 0
+		s.readers.Add(1)
+		go s.tcpReader(conn)
+	}
+}
+
+// tcpReader reads the queries of one connection until the client closes it, it
+// stays idle for TCPIdleTimeout or TCPMaxQueries queries were read. The
+// connection is closed after every queued query got its response.
+func (s *Socket) tcpReader(conn net.Conn) {
+	c := &tcpConn{conn: conn, proto: "tcp"}
+	if _, ok := conn.(*tls.Conn); ok {
+		c.proto = "tls"
+	}
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.readers.Done()
+		c.pending.Wait()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.log.Println(err)
+		}
+	}()
+
+	for i := 0; s.opts.TCPMaxQueries <= 0 || i < s.opts.TCPMaxQueries; i++ {
+		if s.opts.TCPIdleTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.opts.TCPIdleTimeout)); err != nil {
+				s.log.Println(err)
+				return
+			}
+		}
+		// Shutdown sets closing before interrupting the reads, so the
+		// deadline set above can't hide it
+		if s.closing.Load() {
+			return
+		}
+		msg, err := readTCPMsg(conn, s.getBuf)
+		if err != nil {
+			var netErr net.Error
+			if !s.closing.Load() && !errors.Is(err, io.EOF) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				s.log.Println(err)
+			}
+			return
+		}
+
+		c.pending.Add(1)
+		req := QueueRequest{
+			Data:   msg,
+			Addr:   conn.RemoteAddr(),
+			Length: len(msg),
+			w:      c,
+		}
+		if !s.enqueue(req) {
+			c.pending.Done()
+			s.putBuf(msg)
+			return
+		}
+	}
+}
+
+// readTCPMsg reads one length prefixed dns message into a buffer returned by
+// getBuf.
+func readTCPMsg(r io.Reader, getBuf func(n int) []byte) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n == 0 {
+		return nil, fmt.Errorf("read tcp message: zero length")
+	}
+
+	buf := getBuf(n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read tcp message: %w", err)
+	}
+	return buf, nil
+}
+
+// writeTCPMsg writes b prefixed with its length in a single write.
+func writeTCPMsg(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("write tcp message: message too long (%d bytes)", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
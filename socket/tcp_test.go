@@ -0,0 +1,166 @@
+package socket_test
+
+import (
+	"context"
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTCPSocket(t *testing.T, upstream string, maxQueries int) *socket.Socket {
+	t.Helper()
+	s, err := socket.NewSocket(args.SocketArgs{
+		Addr:           "127.0.0.1:0",
+		Network:        "udp",
+		DNSAddr:        upstream,
+		CacheSize:      128,
+		Workers:        2,
+		TCP:            true,
+		TCPIdleTimeout: time.Second,
+		TCPMaxQueries:  maxQueries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ListenAndServe()
+	t.Cleanup(func() { shutdown(s) })
+	return s
+}
+
+func TestTCPPipelining(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newTCPSocket(t, u.addr, 0)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	names := map[uint16]string{1: "a.example.", 2: "b.example.", 3: "c.example."}
+	for id, name := range names {
+		if err := writeMsg(conn, newQuery(t, id, name, dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range names {
+		b, err := readMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		name, ok := names[resp.ID]
+		if !ok {
+			t.Fatalf("unexpected id %d", resp.ID)
+		}
+		delete(names, resp.ID)
+		if resp.Questions[0].Name.String() != name || len(resp.Answers) != 1 {
+			t.Fatalf("bad response for %s: %+v", name, resp)
+		}
+	}
+}
+
+func TestTCPMaxQueries(t *testing.T) {
+	u := startUpstream(t, nil)
+	s := newTCPSocket(t, u.addr, 1)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := writeMsg(conn, newQuery(t, 1, "a.example.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMsg(conn); err != nil {
+		t.Fatal(err)
+	}
+	// the server must close the connection after the first query
+	if err := writeMsg(conn, newQuery(t, 2, "b.example.", dnsmessage.TypeA)); err == nil {
+		if _, err := readMsg(conn); err == nil {
+			t.Fatal("connection should have been closed")
+		}
+	}
+}
+
+// flakyListener fails the accepts with errs in turn, a nil error accepting
+// from the listener.
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	var err error
+	if len(l.errs) > 0 {
+		err, l.errs = l.errs[0], l.errs[1:]
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	logger := &recordLogger{}
+	s, err := socket.New(socket.Options{Upstreams: []string{"127.0.0.1:53"}, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(s) })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("too many open files")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, &flakyListener{Listener: l, errs: []error{fail, fail, fail, nil, fail}})
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the delay doubles, and is reset once a connection is accepted
+	want := []string{"5ms", "10ms", "20ms", "5ms"}
+	var delays []string
+	for deadline := time.Now().Add(5 * time.Second); len(delays) < len(want) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		logger.mu.Lock()
+		delays = delays[:0]
+		for _, line := range logger.lines {
+			if _, delay, ok := strings.Cut(line, "retrying in "); ok {
+				delays = append(delays, strings.TrimSpace(delay))
+			}
+		}
+		logger.mu.Unlock()
+	}
+	if strings.Join(delays, " ") != strings.Join(want, " ") {
+		t.Errorf("got delays %v, want %v", delays, want)
+	}
+}
+
+func TestTCPNetwork(t *testing.T) {
+	_, err := socket.NewSocket(args.SocketArgs{Addr: "127.0.0.1:0", Network: "tcp", DNSAddr: "127.0.0.1:53", CacheSize: 128, Workers: 1})
+	if err == nil || !strings.Contains(err.Error(), "-tcp") {
+		t.Errorf("the error should point at -tcp: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package socket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// listenTLS listens for dns over tls (RFC 7858) on addr. Its connections are
+// served like the tcp ones once the handshake is done.
+func listenTLS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"dot"},
+		// session tickets are enabled, crypto/tls rotates their keys, so
+		// clients can resume their sessions instead of a full handshake
+		SessionTicketsDisabled: false,
+	}
+	return tls.Listen("tcp", addr, config)
+}
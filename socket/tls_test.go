@@ -0,0 +1,70 @@
+package socket_test
+
+import (
+	"crypto/tls"
+	"dns-resolver/args"
+	"dns-resolver/socket"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoT(t *testing.T) {
+	u := startUpstream(t, nil)
+	certFile, keyFile, pool := selfSignedCert(t)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:        u.addr,
+		DoTAddr:        "127.0.0.1:0",
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TCPIdleTimeout: time.Second,
+	})
+
+	config := &tls.Config{
+		RootCAs:            pool,
+		ServerName:         "127.0.0.1",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	for i, resume := range []bool{false, true} {
+		conn, err := tls.Dial("tcp", s.TLSAddr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if err := writeMsg(conn, newQuery(t, uint16(i), "a.example.", dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := readMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != uint16(i) || len(resp.Answers) != 1 {
+			t.Errorf("bad response: %+v", resp)
+		}
+		if got := conn.ConnectionState().DidResume; got != resume {
+			t.Errorf("connection %d: resumed %v, want %v", i, got, resume)
+		}
+		conn.Close()
+	}
+}
+
+func TestDoTBadCert(t *testing.T) {
+	_, err := socket.NewSocket(args.SocketArgs{
+		Addr:      "127.0.0.1:0",
+		Network:   "udp",
+		DNSAddr:   "127.0.0.1:53",
+		CacheSize: 128,
+		DoTAddr:   "127.0.0.1:0",
+		CertFile:  "missing.pem",
+		KeyFile:   "missing.pem",
+	})
+	if err == nil {
+		t.Fatal("missing certificate should fail")
+	}
+}
@@ -0,0 +1,404 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultUpstreamTimeout bounds a single exchange with an upstream when
+	// no UpstreamTimeout is set
+	defaultUpstreamTimeout = 2 * time.Second
+	// maxRetryBackoff caps the wait between two rounds of attempts
+	maxRetryBackoff = 2 * time.Second
+)
+
+// errServerFailure is returned by exchanges answered with SERVFAIL
+var errServerFailure = errors.New("upstream answered with server failure")
+
+// exchanger sends queries to an upstream over one transport, it's implemented
+// by connPool and dohClient.
+type exchanger interface {
+	exchange(q *upstreamQuery) ([]byte, error)
+	stats() PoolStats
+	// close closes the connections kept open
+	close()
+}
+
+// Upstream is a remote dns the queries missing the cache are forwarded to.
+// It's marked down after maxFails consecutive failed exchanges or probes and
+// back up on the first successful one.
+type Upstream struct {
+	addr    string
+	network string
+	weight  int
+	// udp and tcp carry the queries of udp and tcp clients, they are the same
+	// for encrypted upstreams
+	udp     exchanger
+	tcp     exchanger
+	healthy atomic.Bool
+	fails   atomic.Int32
+	// rtt is an exponentially weighted moving average of the round trip
+	// time of the exchanges, in nanoseconds
+	rtt atomic.Int64
+	log Logger
+}
+
+// rttWeight is how much a new sample counts in the rtt moving average
+const rttWeight = 0.3
+
+func newUpstream(addr string, weight int, timeout time.Duration, conns int, logger Logger) *Upstream {
+	u := &Upstream{
+		addr:    addr,
+		network: "udp",
+		weight:  weight,
+		udp:     newConnPool("udp", addr, conns, timeout, logger),
+		tcp:     newConnPool("tcp", addr, conns, timeout, logger),
+		log:     logger,
+	}
+	u.healthy.Store(true)
+	return u
+}
+
+// parseUpstreams parses a list of upstream addresses, each one optionally
+// followed by @weight. The port defaults to 53 and the weight to 1.
+// Encrypted upstreams are given as tls:// or https:// urls, see
+// newEncryptedUpstream.
+func parseUpstreams(list []string, timeout time.Duration, conns int, logger Logger) ([]*Upstream, error) {
+	var us []*Upstream
+	for _, addr := range list {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		weight := 1
+		if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+			w, err := strconv.Atoi(addr[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight for upstream %q", addr)
+			}
+			addr, weight = addr[:i], w
+		}
+		if strings.Contains(addr, "://") {
+			u, err := newEncryptedUpstream(addr, weight, timeout, conns, logger)
+			if err != nil {
+				return nil, err
+			}
+			us = append(us, u)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+		}
+		us = append(us, newUpstream(addr, weight, timeout, conns, logger))
+	}
+	if len(us) == 0 {
+		return nil, fmt.Errorf("no upstream dns given")
+	}
+	return us, nil
+}
+
+// protocol returns the transport the queries of udp, or tcp, clients are sent
+// to u over.
+func (u *Upstream) protocol(tcp bool) string {
+	if u.network == "udp" && tcp {
+		return "tcp"
+	}
+	return u.network
+}
+
+// ipPort returns the ip and port of u, the ip is nil if u is given by name.
+func (u *Upstream) ipPort() (net.IP, uint32) {
+	addr := strings.TrimPrefix(u.addr, "tls://")
+	if parsed, err := url.Parse(u.addr); err == nil && parsed.Scheme == "https" {
+		addr = parsed.Host
+		if parsed.Port() == "" {
+			addr = net.JoinHostPort(parsed.Hostname(), "443")
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return net.ParseIP(host), uint32(p)
+}
+
+// Addr returns the address of the upstream.
+func (u *Upstream) Addr() string {
+	return u.addr
+}
+
+// Weight returns the weight of the upstream, used by the random strategy.
+func (u *Upstream) Weight() int {
+	return u.weight
+}
+
+// Healthy reports whether the upstream is up.
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// RTT returns the moving average of the upstream round trip time, zero until
+// its first exchange.
+func (u *Upstream) RTT() time.Duration {
+	return time.Duration(u.rtt.Load())
+}
+
+func (u *Upstream) observeRTT(d time.Duration) {
+	for {
+		old := u.rtt.Load()
+		avg := int64(d)
+		if old != 0 {
+			avg = int64(rttWeight*float64(d) + (1-rttWeight)*float64(old))
+		}
+		if u.rtt.CompareAndSwap(old, avg) {
+			return
+		}
+	}
+}
+
+func (u *Upstream) markSuccess() {
+	u.fails.Store(0)
+	if !u.healthy.Swap(true) {
+		u.log.Printf("upstream %s is up again\n", u.addr)
+	}
+}
+
+func (u *Upstream) markFailure(maxFails int) {
+	if int(u.fails.Add(1)) >= maxFails && u.healthy.Swap(false) {
+		u.log.Printf("upstream %s is down\n", u.addr)
+	}
+}
+
+// Forward is the plugin forwarding the queries to the upstreams, it ends the
+// chain: the next plugins are never called. Identical queries in flight at
+// the same time are forwarded once.
+func Forward(s *Socket, _ Handler) Handler {
+	return HandlerFunc(s.forwardQuery)
+}
+
+func (s *Socket) forwardQuery(ctx context.Context, w ResponseWriter, r *dnsmessage.Message) {
+	_, queryOPT := splitOPT(r.Additionals)
+	tcp := w.Stream()
+	edns := newClientEDNS(queryOPT, tcp, s.opts.EDNSSize)
+	in, err := r.Pack()
+	if err != nil {
+		s.log.Println(err)
+		return
+	}
+	fkey := flightKey{
+		cacheKey: cacheKey{
+			question:         r.Questions[0],
+			dnssecOK:         edns.dnssecOK,
+			checkingDisabled: r.CheckingDisabled,
+		},
+		tcp:  tcp,
+		edns: edns.opt != nil,
+	}
+	g := s.route(r.Questions[0].Name.String())
+	resp, upstream, err, shared := s.flights.do(fkey, func() ([]byte, string, error) {
+		// tcp clients usually retry here after a truncated udp answer, so
+		// the query has to go upstream over tcp as well
+		return s.forward(ctx, g, in, tcp)
+	})
+	if err != nil {
+		s.log.Println(err)
+		// let the client know instead of having it wait for its own timeout
+		s.WriteError(w, r, dnsmessage.RCodeServerFailure)
+		return
+	}
+	if info := queryInfoFrom(ctx); info != nil {
+		info.upstream = upstream
+	}
+	if shared {
+		resp = withID(resp, r.ID)
+	}
+	// write response to user, truncated if needed
+	if _, err = w.Write(resp); err != nil {
+		s.log.Println(err)
+	}
+}
+
+// forward sends a query to the upstreams of g, in the order its strategy picks
+// them, until one of them answers with something else than SERVFAIL. When a
+// whole round fails it's retried up to Retries times, waiting RetryBackoff
+// before the first retry and twice as long before each next one.
+// If no upstream answers the last SERVFAIL response is returned, if there was
+// one. The retries stop once ctx is done. The address of the upstream the
+// response came from is returned along with it.
+func (s *Socket) forward(ctx context.Context, g *upstreamGroup, in []byte, tcp bool) ([]byte, string, error) {
+	var (
+		lastErr  error
+		failResp []byte
+		failAddr string
+	)
+	backoff := s.opts.RetryBackoff
+	for round := 0; round <= s.opts.Retries; round++ {
+		if round > 0 && backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, "", ctx.Err()
+			}
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		for _, u := range g.strategy.Select(g.upstreams) {
+			resp, err := s.exchange(u, in, tcp)
+			if err == nil {
+				u.markSuccess()
+				return resp, u.addr, nil
+			}
+
+			u.markFailure(s.opts.MaxFails)
+			lastErr = fmt.Errorf("forward to %s: %w", u.addr, err)
+			if errors.Is(err, errServerFailure) {
+				failResp, failAddr = resp, u.addr
+			}
+		}
+	}
+	if failResp != nil {
+		return failResp, failAddr, nil
+	}
+	return nil, "", lastErr
+}
+
+// exchange sends a query to u and returns its response. A SERVFAIL response
+// is returned along with errServerFailure.
+func (s *Socket) exchange(u *Upstream, in []byte, tcp bool) ([]byte, error) {
+	q, err := newUpstreamQuery(in)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := u.udp
+	if tcp {
+		transport = u.tcp
+	}
+	proto := u.protocol(tcp)
+	start := time.Now()
+	if s.opts.Dnstap != nil {
+		// the query is logged with the id the transport gives it
+		q.sent = func(msg []byte) {
+			s.tapForwarder(DnstapForwarderQuery, u, proto, start, msg, time.Time{}, nil)
+		}
+	}
+	resp, err := transport.exchange(q)
+	if err != nil {
+		s.metrics.upstreamRequests.inc(u.addr, proto, "error")
+		return nil, err
+	}
+	rtt := time.Since(start)
+	if s.opts.Dnstap != nil {
+		s.tapForwarder(DnstapForwarderResponse, u, proto, start, q.msg, start.Add(rtt), resp)
+	}
+	u.observeRTT(rtt)
+	s.metrics.upstreamDuration.observe(rtt, u.addr, proto)
+	q.restoreID(resp)
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		s.metrics.upstreamRequests.inc(u.addr, proto, "error")
+		return nil, err
+	}
+	if header.RCode == dnsmessage.RCodeServerFailure {
+		s.metrics.upstreamRequests.inc(u.addr, proto, "servfail")
+		return resp, errServerFailure
+	}
+	s.metrics.upstreamRequests.inc(u.addr, proto, "success")
+	return resp, nil
+}
+
+// tapForwarder sends a forwarder message to dnstap.
+func (s *Socket) tapForwarder(typ DnstapType, u *Upstream, proto string, queryTime time.Time, query []byte, respTime time.Time, resp []byte) {
+	ip, port := u.ipPort()
+	s.opts.Dnstap.Log(&DnstapMessage{
+		Type:            typ,
+		Protocol:        proto,
+		ResponseAddress: ip,
+		ResponsePort:    port,
+		QueryTime:       queryTime,
+		QueryMessage:    query,
+		ResponseTime:    respTime,
+		ResponseMessage: resp,
+	})
+}
+
+// healthChecker probes every upstream each HealthInterval, until Shutdown.
+func (s *Socket) healthChecker() {
+	ticker := time.NewTicker(s.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		for _, u := range s.upstreams {
+			go func(u *Upstream) {
+				if err := s.probe(u); err != nil {
+					u.markFailure(s.opts.MaxFails)
+					return
+				}
+				u.markSuccess()
+			}(u)
+		}
+	}
+}
+
+// probe asks u for the name servers of the root zone. Unlike the forwarded
+// queries, probes are left out of the metrics and of dnstap.
+func (s *Socket) probe(u *Upstream) error {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeNS,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	q, err := newUpstreamQuery(query)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := u.udp.exchange(q)
+	if err != nil {
+		return err
+	}
+	u.observeRTT(time.Since(start))
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return err
+	}
+	if header.RCode == dnsmessage.RCodeServerFailure {
+		return errServerFailure
+	}
+	return nil
+}
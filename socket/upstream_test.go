@@ -0,0 +1,163 @@
+package socket_test
+
+import (
+	"dns-resolver/args"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// servfailUntil returns a handler answering SERVFAIL as long as failing is set.
+func servfailUntil(failing *atomic.Bool) func(q dnsmessage.Message) dnsmessage.Message {
+	ok := answerA([4]byte{1, 2, 3, 4}, 300)
+	return func(q dnsmessage.Message) dnsmessage.Message {
+		if failing.Load() {
+			return dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeServerFailure},
+				Questions: q.Questions,
+			}
+		}
+		return ok(q)
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	primary := startUpstream(t, servfailUntil(&failing))
+	secondary := startUpstream(t, answerA([4]byte{5, 6, 7, 8}, 300))
+
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:        primary.addr + "," + secondary.addr,
+		MaxFails:       1,
+		HealthInterval: 50 * time.Millisecond,
+	})
+
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Fatalf("query should have failed over to the secondary: %+v", resp)
+	}
+	if secondary.queries.Load() != 1 {
+		t.Fatalf("secondary should have been asked once, got %d", secondary.queries.Load())
+	}
+
+	// the primary recovers, the health probes should bring it back up
+	failing.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("b%d.example.", i)
+		resp := exchange(t, s.Addr().String(), newQuery(t, uint16(i), name, dnsmessage.TypeA))
+		if a, ok := resp.Answers[0].Body.(*dnsmessage.AResource); ok && a.A == [4]byte{1, 2, 3, 4} {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("primary never came back up")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestUpstreamAllFailing(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	u := startUpstream(t, servfailUntil(&failing))
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: u.addr})
+
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("the upstream SERVFAIL should be passed on: %+v", resp)
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	u := startUpstream(t, nil)
+	u.drop.Store(1)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:         u.addr,
+		UpstreamTimeout: 100 * time.Millisecond,
+		Retries:         1,
+		RetryBackoff:    10 * time.Millisecond,
+	})
+
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Fatalf("the retry should have been answered: %+v", resp)
+	}
+	if n := u.queries.Load(); n != 2 {
+		t.Errorf("upstream should have been asked twice, got %d", n)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	u := startUpstream(t, nil)
+	u.drop.Store(1 << 30)
+	s := newUDPSocket(t, args.SocketArgs{
+		DNSAddr:         u.addr,
+		UpstreamTimeout: 100 * time.Millisecond,
+		Retries:         2,
+		RetryBackoff:    10 * time.Millisecond,
+	})
+
+	start := time.Now()
+	resp := exchange(t, s.Addr().String(), newQuery(t, 1, "a.example.", dnsmessage.TypeA))
+	if resp.RCode != dnsmessage.RCodeServerFailure || resp.ID != 1 || len(resp.Questions) != 1 {
+		t.Fatalf("client should get a SERVFAIL: %+v", resp)
+	}
+	if n := u.queries.Load(); n != 3 {
+		t.Errorf("upstream should have been asked 3 times, got %d", n)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took too long to give up: %v", d)
+	}
+}
+
+func TestUpstreamSpoofedReplies(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ids := make(chan uint16, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(buf[:n]); err != nil {
+			return
+		}
+		ids <- q.ID
+
+		reply := func(id uint16, name string, ip [4]byte) {
+			spoofed := q
+			spoofed.ID = id
+			spoofed.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+			resp := answerA(ip, 300)(spoofed)
+			b, _ := resp.Pack()
+			pc.WriteTo(b, addr)
+		}
+		reply(q.ID+1, "a.example.", [4]byte{6, 6, 6, 6})
+		reply(q.ID, "evil.example.", [4]byte{6, 6, 6, 6})
+		reply(q.ID, "A.Example.", [4]byte{1, 2, 3, 4})
+	}()
+
+	s := newUDPSocket(t, args.SocketArgs{DNSAddr: pc.LocalAddr().String()})
+	resp := exchange(t, s.Addr().String(), newQuery(t, 42, "a.example.", dnsmessage.TypeA))
+	if resp.ID != 42 {
+		t.Errorf("response should carry the client id: %d", resp.ID)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+		t.Errorf("spoofed reply was accepted: %+v", resp)
+	}
+	// a 1 in 65536 chance of a false failure is fine here
+	if id := <-ids; id == 42 {
+		t.Errorf("upstream query id should be randomized")
+	}
+}
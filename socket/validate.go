@@ -0,0 +1,100 @@
+package socket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamQuery is a query as it's sent upstream: a copy of the client's one
+// with a random id given by the connection it's sent on, so an off path
+// attacker can't guess it to forge replies.
+type upstreamQuery struct {
+	msg      []byte
+	id       uint16
+	clientID uint16
+	question []dnsmessage.Question
+	// sent, if not nil, is called with the message as it's sent, once its
+	// id is set
+	sent func(msg []byte)
+}
+
+func newUpstreamQuery(in []byte) (*upstreamQuery, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(in)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, len(in))
+	copy(msg, in)
+	return &upstreamQuery{
+		msg:      msg,
+		id:       header.ID,
+		clientID: header.ID,
+		question: question,
+	}, nil
+}
+
+// setID sets the id q is sent with, the transports call it right before
+// sending q.
+func (q *upstreamQuery) setID(id uint16) {
+	q.id = id
+	binary.BigEndian.PutUint16(q.msg, id)
+	if q.sent != nil {
+		q.sent(q.msg)
+	}
+}
+
+func randomID() (uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(id[:]), nil
+}
+
+// check verifies resp is a response to q: same id and same question.
+func (q *upstreamQuery) check(resp []byte) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return err
+	}
+	if !header.Response {
+		return fmt.Errorf("not a response")
+	}
+	if header.ID != q.id {
+		return fmt.Errorf("id mismatch: sent %d, got %d", q.id, header.ID)
+	}
+	question, err := parser.AllQuestions()
+	if err != nil {
+		return err
+	}
+	if len(question) != len(q.question) {
+		return fmt.Errorf("question mismatch: sent %d questions, got %d", len(q.question), len(question))
+	}
+	for i := range question {
+		if !sameQuestion(question[i], q.question[i]) {
+			return fmt.Errorf("question mismatch: sent %v, got %v", q.question[i], question[i])
+		}
+	}
+	return nil
+}
+
+// restoreID gives resp the id of the client query back.
+func (q *upstreamQuery) restoreID(resp []byte) {
+	binary.BigEndian.PutUint16(resp, q.clientID)
+}
+
+// sameQuestion compares questions, names are case insensitive.
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
@@ -0,0 +1,430 @@
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type (
+	// zoneToken is a field of a zone file entry, quoted ones may be empty.
+	zoneToken struct {
+		s      string
+		quoted bool
+	}
+
+	// zoneParser reads the records of a zone file in the RFC 1035 master
+	// file format.
+	zoneParser struct {
+		scanner *bufio.Scanner
+		line    int
+		origin  string
+		// ttl is the one set by $TTL, lastTTL the one of the previous
+		// record, used when there's no $TTL
+		ttl, lastTTL    uint32
+		hasTTL, hasLast bool
+		owner           string
+	}
+)
+
+// parseZone returns the records of a zone file. origin completes the
+// relative names until the file sets one with $ORIGIN, they are rejected if
+// it's empty. $INCLUDE and the classes other than IN are not supported.
+func parseZone(r io.Reader, origin string) ([]dnsmessage.Resource, error) {
+	p := &zoneParser{scanner: bufio.NewScanner(r), origin: origin}
+	var records []dnsmessage.Resource
+	for {
+		tokens, blankOwner, err := p.entry()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+		if tokens == nil {
+			return records, nil
+		}
+		rr, ok, err := p.record(tokens, blankOwner)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+		if ok {
+			records = append(records, rr)
+		}
+	}
+}
+
+// entry returns the tokens of the next entry, which spans several lines
+// within parentheses, nil at the end of the file. blankOwner reports whether
+// it starts with a blank, the owner being the previous one.
+func (p *zoneParser) entry() (tokens []zoneToken, blankOwner bool, err error) {
+	depth := 0
+	for p.scanner.Scan() {
+		p.line++
+		line := p.scanner.Text()
+		if tokens == nil && depth == 0 {
+			blankOwner = line != "" && (line[0] == ' ' || line[0] == '\t')
+		}
+		if tokens, depth, err = lexZoneLine(line, tokens, depth); err != nil {
+			return nil, false, err
+		}
+		if depth == 0 && len(tokens) > 0 {
+			return tokens, blankOwner, nil
+		}
+	}
+	if err := p.scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if depth > 0 {
+		return nil, false, fmt.Errorf("unclosed parenthesis")
+	}
+	return nil, false, nil
+}
+
+// lexZoneLine appends the tokens of a line to tokens, depth is the number of
+// parentheses open.
+func lexZoneLine(line string, tokens []zoneToken, depth int) ([]zoneToken, int, error) {
+	for i := 0; i < len(line); {
+		switch c := line[i]; c {
+		case ' ', '\t', '\r':
+			i++
+		case ';':
+			return tokens, depth, nil
+		case '(':
+			depth++
+			i++
+		case ')':
+			if depth == 0 {
+				return nil, 0, fmt.Errorf("unbalanced parenthesis")
+			}
+			depth--
+			i++
+		default:
+			var b strings.Builder
+			quoted := c == '"'
+			if quoted {
+				i++
+			}
+			for ; i < len(line); i++ {
+				c = line[i]
+				if quoted && c == '"' {
+					break
+				}
+				if !quoted && strings.IndexByte(" \t\r;()\"", c) >= 0 {
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					if i+2 < len(line) && isDigits(line[i:i+3]) {
+						n, _ := strconv.Atoi(line[i : i+3])
+						if n > 255 {
+							return nil, 0, fmt.Errorf("invalid escape \\%s", line[i:i+3])
+						}
+						b.WriteByte(byte(n))
+						i += 2
+						continue
+					}
+					c = line[i]
+				}
+				b.WriteByte(c)
+			}
+			if quoted {
+				if i == len(line) {
+					return nil, 0, fmt.Errorf("unclosed quote")
+				}
+				i++
+			}
+			tokens = append(tokens, zoneToken{s: b.String(), quoted: quoted})
+		}
+	}
+	return tokens, depth, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// record parses an entry, it reports false for the directives.
+func (p *zoneParser) record(tokens []zoneToken, blankOwner bool) (dnsmessage.Resource, bool, error) {
+	var rr dnsmessage.Resource
+	if !blankOwner && strings.HasPrefix(tokens[0].s, "$") && !tokens[0].quoted {
+		return rr, false, p.directive(tokens)
+	}
+
+	if !blankOwner {
+		owner, err := p.name(tokens[0].s)
+		if err != nil {
+			return rr, false, err
+		}
+		p.owner, tokens = owner, tokens[1:]
+	} else if p.owner == "" {
+		return rr, false, fmt.Errorf("no previous owner name")
+	}
+
+	var (
+		ttl    uint32
+		hasTTL bool
+		typ    string
+	)
+	for len(tokens) > 0 && typ == "" {
+		tok := strings.ToUpper(tokens[0].s)
+		tokens = tokens[1:]
+		if v, ok := parseTTL(tok); ok && !hasTTL {
+			ttl, hasTTL = v, true
+			continue
+		}
+		switch tok {
+		case "IN":
+		case "CH", "HS", "CS":
+			return rr, false, fmt.Errorf("unsupported class %s", tok)
+		default:
+			typ = tok
+		}
+	}
+	if typ == "" {
+		return rr, false, fmt.Errorf("missing record type")
+	}
+
+	rtype, body, err := p.body(typ, tokens)
+	if err != nil {
+		return rr, false, fmt.Errorf("%s record: %w", typ, err)
+	}
+	switch {
+	case hasTTL:
+	case p.hasTTL:
+		ttl = p.ttl
+	case p.hasLast:
+		ttl = p.lastTTL
+	case typ == "SOA":
+		ttl = body.(*dnsmessage.SOAResource).MinTTL
+	default:
+		return rr, false, fmt.Errorf("missing ttl and no $TTL")
+	}
+	p.lastTTL, p.hasLast = ttl, true
+
+	name, err := dnsmessage.NewName(p.owner)
+	if err != nil {
+		return rr, false, err
+	}
+	rr = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+	return rr, true, nil
+}
+
+// directive handles $ORIGIN and $TTL.
+func (p *zoneParser) directive(tokens []zoneToken) error {
+	if len(tokens) != 2 {
+		return fmt.Errorf("%s expects one argument", tokens[0].s)
+	}
+	switch strings.ToUpper(tokens[0].s) {
+	case "$ORIGIN":
+		origin, err := p.name(tokens[1].s)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		ttl, ok := parseTTL(tokens[1].s)
+		if !ok {
+			return fmt.Errorf("invalid ttl %q", tokens[1].s)
+		}
+		p.ttl, p.hasTTL = ttl, true
+	default:
+		return fmt.Errorf("unsupported directive %s", tokens[0].s)
+	}
+	return nil
+}
+
+// name returns the fully qualified form of a name, @ being the origin.
+func (p *zoneParser) name(s string) (string, error) {
+	switch {
+	case s == "@":
+		s = p.origin
+	case strings.HasSuffix(s, "."):
+	case p.origin == "":
+		return "", fmt.Errorf("relative name %q without $ORIGIN", s)
+	case p.origin == ".":
+		s += "."
+	default:
+		s += "." + p.origin
+	}
+	if s == "" {
+		return "", fmt.Errorf("@ without $ORIGIN")
+	}
+	if _, err := dnsmessage.NewName(s); err != nil {
+		return "", fmt.Errorf("invalid name %q: %w", s, err)
+	}
+	return s, nil
+}
+
+// body parses the rdata of a record of type typ.
+func (p *zoneParser) body(typ string, tokens []zoneToken) (dnsmessage.Type, dnsmessage.ResourceBody, error) {
+	fields := make([]string, len(tokens))
+	for i, tok := range tokens {
+		fields[i] = tok.s
+	}
+	want := map[string]int{
+		"A": 1, "AAAA": 1, "CNAME": 1, "PTR": 1, "NS": 1, "MX": 2, "SRV": 4, "SOA": 7,
+	}
+	if n, ok := want[typ]; ok && len(fields) != n {
+		return 0, nil, fmt.Errorf("expected %d fields, got %d", n, len(fields))
+	}
+
+	names := func(fields ...string) ([]dnsmessage.Name, error) {
+		ns := make([]dnsmessage.Name, len(fields))
+		for i, f := range fields {
+			s, err := p.name(f)
+			if err != nil {
+				return nil, err
+			}
+			if ns[i], err = dnsmessage.NewName(s); err != nil {
+				return nil, err
+			}
+		}
+		return ns, nil
+	}
+
+	switch typ {
+	case "A":
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil || strings.Contains(fields[0], ":") {
+			return 0, nil, fmt.Errorf("invalid ipv4 address %q", fields[0])
+		}
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip)
+		return dnsmessage.TypeA, body, nil
+	case "AAAA":
+		ip := net.ParseIP(fields[0])
+		if ip == nil || !strings.Contains(fields[0], ":") {
+			return 0, nil, fmt.Errorf("invalid ipv6 address %q", fields[0])
+		}
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip)
+		return dnsmessage.TypeAAAA, body, nil
+	case "CNAME":
+		ns, err := names(fields...)
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: ns[0]}, nil
+	case "PTR":
+		ns, err := names(fields...)
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: ns[0]}, nil
+	case "NS":
+		ns, err := names(fields...)
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeNS, &dnsmessage.NSResource{NS: ns[0]}, nil
+	case "MX":
+		pref, err := parseUint16(fields[0])
+		if err != nil {
+			return 0, nil, err
+		}
+		ns, err := names(fields[1])
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeMX, &dnsmessage.MXResource{Pref: pref, MX: ns[0]}, nil
+	case "TXT":
+		if len(fields) == 0 {
+			return 0, nil, fmt.Errorf("no strings")
+		}
+		for _, f := range fields {
+			if len(f) > 255 {
+				return 0, nil, fmt.Errorf("string longer than 255 bytes")
+			}
+		}
+		return dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: fields}, nil
+	case "SRV":
+		var v [3]uint16
+		for i := range v {
+			n, err := parseUint16(fields[i])
+			if err != nil {
+				return 0, nil, err
+			}
+			v[i] = n
+		}
+		ns, err := names(fields[3])
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeSRV, &dnsmessage.SRVResource{Priority: v[0], Weight: v[1], Port: v[2], Target: ns[0]}, nil
+	case "SOA":
+		ns, err := names(fields[0], fields[1])
+		if err != nil {
+			return 0, nil, err
+		}
+		serial, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid serial %q", fields[2])
+		}
+		var times [4]uint32
+		for i := range times {
+			ttl, ok := parseTTL(fields[3+i])
+			if !ok {
+				return 0, nil, fmt.Errorf("invalid time %q", fields[3+i])
+			}
+			times[i] = ttl
+		}
+		return dnsmessage.TypeSOA, &dnsmessage.SOAResource{
+			NS: ns[0], MBox: ns[1], Serial: uint32(serial),
+			Refresh: times[0], Retry: times[1], Expire: times[2], MinTTL: times[3],
+		}, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported type")
+	}
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(n), nil
+}
+
+// parseTTL parses a ttl in seconds, or with the units of BIND: 1h30m, 1w.
+func parseTTL(s string) (uint32, bool) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, false
+	}
+	if isDigits(s) {
+		n, err := strconv.ParseUint(s, 10, 32)
+		return uint32(n), err == nil
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n, digits = n*10+uint64(c-'0'), true
+			if n > math.MaxUint32 {
+				return 0, false
+			}
+			continue
+		}
+		unit := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if unit == 0 || !digits {
+			return 0, false
+		}
+		total += n * unit
+		n, digits = 0, false
+	}
+	if digits || total > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(total), true
+}